@@ -4,11 +4,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,91 +27,120 @@ func main() {
 	var users int
 	var windowDays int
 	var subs int
-	flag.StringVar(&mode, "mode", "baseline", "benchmark mode: baseline | range | hash | hash-consistent")
+	var exact bool
+	var stream bool
+	var partial bool
+	var timeout, shardTimeout, hedgeAfter time.Duration
+	var hedgePercentile float64
+	var replicaBalance string
+	var maxLag time.Duration
+	var failover bool
+	var scheme string
+	var weightList string
+	var epsilon float64
+	var topologyFile string
+	var rebalance bool
+	flag.StringVar(&mode, "mode", "baseline", "benchmark mode: "+strings.Join(router.Modes(), " | "))
 	flag.IntVar(&concurrency, "concurrency", 50, "number of concurrent workers")
 	flag.IntVar(&requests, "requests", 1000, "total number of requests")
 	flag.IntVar(&limit, "limit", 50, "feed limit")
 	flag.IntVar(&users, "users", 10000, "user id space (1..users)")
-	flag.IntVar(&windowDays, "windowDays", 0, "time window in days for created_at cutoff (0 = no cutoff)")
+	flag.IntVar(&windowDays, "windowDays", 0, "time window in days for created_at cutoff, back from the end of the seeded data (0 = its last calendar month)")
 	flag.IntVar(&subs, "subs", 10, "number of user_ids per request")
+	flag.BoolVar(&stream, "stream", false, "stream fan-out reads through FeedIterator (heap merge) and report time to first row")
+	flag.BoolVar(&partial, "partial", false, "degraded mode: return posts from healthy shards when a shard fails")
+	flag.DurationVar(&timeout, "timeout", 0, "per-request deadline (0 = none)")
+	flag.DurationVar(&shardTimeout, "shardTimeout", 0, "per-shard query timeout in fan-out modes, capped by -timeout (0 = none)")
+	flag.DurationVar(&hedgeAfter, "hedgeAfter", 0, "send a hedged duplicate to a shard slower than this (0 = off)")
+	flag.Float64Var(&hedgePercentile, "hedgePercentile", 0, "hedge shards slower than their recent latency percentile, e.g. 0.95 (0 = off)")
+	flag.StringVar(&replicaBalance, "replicaBalance", string(router.BalanceRoundRobin), "replica selection when SHARD_<n>_REPLICAS is set: round-robin | least-outstanding")
+	flag.DurationVar(&maxLag, "maxLag", 0, "skip replicas lagging more than this (0 = no lag check)")
+	flag.BoolVar(&failover, "failover", false, "probe shards and switch a failed one to its SHARD_<n>_STANDBY")
+	flag.BoolVar(&exact, "exact", false, "exact global top-N merge in fan-out modes (refetch instead of LIMIT ceil(limit/shards))")
+	flag.StringVar(&scheme, "partitioner", router.SchemeRing, "consistent hashing scheme for hash-consistent and directory modes: "+strings.Join(router.Schemes(), " | "))
+	flag.StringVar(&weightList, "weights", "", "comma-separated shard weights for -partitioner=ring|rendezvous, e.g. 1,1,2")
+	flag.Float64Var(&epsilon, "epsilon", router.DefaultBoundedEpsilon, "load slack for -partitioner=bounded: a shard takes at most (1+epsilon) x its share of users")
+	flag.StringVar(&topologyFile, "topology", "", "topology file (JSON ShardRing) placing users for hash-consistent and directory modes; cannot be combined with -weights or another -partitioner")
+	flag.BoolVar(&rebalance, "rebalance", false, "route hash-consistent and directory modes by the rebalance_state of posts_hash, following an online rebalance (cmd/migrate -online); overrides -topology, same restrictions")
 	flag.Parse()
 
 	ctx := context.Background()
-	var cutoff time.Time
+	// Seeded posts end at db.RangeUntil, so windows are counted back from there; the
+	// window still runs up to now, which only adds rows written after seeding.
+	end := time.Now()
+	if end.After(db.RangeUntil) {
+		end = db.RangeUntil
+	}
+	cutoff, _ := router.MonthWindow(end.Add(-time.Nanosecond))
 	if windowDays > 0 {
-		cutoff = time.Now().Add(-time.Duration(windowDays) * 24 * time.Hour)
+		cutoff = end.Add(-time.Duration(windowDays) * 24 * time.Hour)
 	}
 
-	// getFeed is bound to the selected router implementation for current mode.
-	var getFeed func(ctx context.Context, userIDs []int64, limit int) error
-
-	switch mode {
-	case "baseline":
-		// Single pool against baseline (non-partitioned) table.
-		pool, err := db.NewBaselinePool(ctx)
-		if err != nil {
-			log.Fatalf("connect baseline: %v", err)
-		}
-		defer pool.Close()
-		r := &router.BaselineRouter{DB: pool}
-		getFeed = func(ctx context.Context, userIDs []int64, limit int) error {
-			_, err := r.GetFeed(ctx, userIDs, limit)
-			return err
-		}
-	case "range":
-		// Single pool pointing to partitioned table in same instance.
-		pool, err := db.NewRangePool(ctx)
-		if err != nil {
-			log.Fatalf("connect range: %v", err)
-		}
-		defer pool.Close()
-		r := &router.RangeRouter{DB: pool}
-		getFeed = func(ctx context.Context, userIDs []int64, limit int) error {
-			_, err := r.GetFeed(ctx, userIDs, limit)
-			return err
-		}
-	case "hash":
-		// Three pools, one per shard; router fans out and merges results.
-		pools, err := db.NewShardPools(ctx)
-		if err != nil {
-			log.Fatalf("connect shards: %v", err)
-		}
-		for _, p := range pools {
-			defer p.Close()
-		}
-		r := &router.HashRouter{Shards: pools}
-		getFeed = func(ctx context.Context, userIDs []int64, limit int) error {
-			_, err := r.GetFeed(ctx, userIDs, limit)
-			return err
+	// Open every instance up front: pgxpool dials lazily, so modes only connect
+	// to the pools their router actually queries.
+	topo, err := router.OpenTopology(ctx)
+	if err != nil {
+		log.Fatalf("connect: %v", err)
+	}
+	defer topo.Close()
+	topo.Fanout.Exact = exact
+	topo.Fanout.AllowPartial = partial
+	topo.Fanout.ShardTimeout = shardTimeout
+	topo.Fanout.Hedge = router.HedgePolicy{After: hedgeAfter, Percentile: hedgePercentile}
+	balance, err := router.ParseReplicaBalance(replicaBalance)
+	if err != nil {
+		log.Fatalf("flags: %v", err)
+	}
+	topo.ReplicaReads = router.ReplicaOptions{Balance: balance, MaxLag: maxLag}
+	topo.Partitioner = scheme
+	if topo.Weights, err = router.ParseWeights(weightList); err != nil {
+		log.Fatalf("weights: %v", err)
+	}
+	topo.Bounded = router.BoundedOptions{Epsilon: epsilon, Users: users}
+	if topologyFile != "" {
+		if topo.Ring, err = router.ReadTopologyFile(topologyFile, topo.ShardPool); err != nil {
+			log.Fatalf("topology: %v", err)
 		}
-	case "hash-consistent":
-		// Consistent hashing router to minimize key movement on shard changes.
-		pools, err := db.NewShardPools(ctx)
+		log.Printf("topology %s: epoch %d, shards %v", topologyFile, topo.Ring.Version(), topo.Ring.Shards())
+	}
+	if rebalance {
+		topo.Rebalance = router.NewRebalanceStore(topo.Baseline, topo.ShardPool, router.RebalanceOptions{})
+		st, err := topo.Rebalance.Refresh(ctx)
 		if err != nil {
-			log.Fatalf("connect shards: %v", err)
-		}
-		for _, p := range pools {
-			defer p.Close()
-		}
-		ring := router.NewRing(200)
-		ids := make([]int, 0, len(pools))
-		for i := range pools {
-			ids = append(ids, i)
+			log.Fatalf("rebalance: %v", err)
 		}
-		ring.Build(ids)
-		r := &router.ConsistentHashRouter{Shards: pools, Ring: ring}
-		getFeed = func(ctx context.Context, userIDs []int64, limit int) error {
-			_, err := r.GetFeed(ctx, userIDs, limit)
-			return err
-		}
-	default:
-		log.Fatalf("unknown mode: %s", mode)
+		log.Printf("rebalance state: %s, epoch %d", st.Phase, st.From.Version())
+		watchCtx, stopWatch := context.WithCancel(ctx)
+		defer stopWatch()
+		go topo.Rebalance.Watch(watchCtx)
+	}
+	if failover {
+		monitorCtx, stopMonitor := context.WithCancel(ctx)
+		defer stopMonitor()
+		topo.StartFailover(monitorCtx, router.FailoverOptions{
+			OnEvent: func(e router.FailoverEvent) { log.Printf("failover event: %s", e) },
+		})
+	}
+	rtr, err := router.New(mode, topo)
+	if err != nil {
+		log.Fatalf("router: %v", err)
 	}
 
 	// result is a per-request measurement for aggregation.
 	type result struct {
-		latency time.Duration
-		err     error
+		latency  time.Duration
+		firstRow time.Duration
+		err      error
+		stats    router.FanoutStats
+	}
+	// Fan-out modes also report how many rows each read transferred.
+	reporter, hasStats := rtr.(router.FanoutReporter)
+	streamer, canStream := rtr.(router.FeedStreamer)
+	if stream && !canStream {
+		log.Fatalf("mode %s does not support -stream", mode)
+	}
+	if stream && (hedgeAfter > 0 || hedgePercentile > 0) {
+		log.Fatalf("flags: -stream cannot be combined with -hedgeAfter/-hedgePercentile")
 	}
 
 	// jobs is a bounded channel; each entry indicates "run one request".
@@ -138,13 +169,25 @@ func main() {
 				}
 				// Time a single logical request (one feed fetch).
 				start := time.Now()
-				callCtx := ctx
-				if windowDays > 0 {
-					callCtx = context.WithValue(ctx, router.CtxCutoffKey, cutoff)
+				callCtx := context.WithValue(ctx, router.CtxCutoffKey, cutoff)
+				cancel := func() {}
+				if timeout > 0 {
+					callCtx, cancel = context.WithTimeout(callCtx, timeout)
 				}
-				err := getFeed(callCtx, userIDs, limit)
+				var stats router.FanoutStats
+				var firstRow time.Duration
+				var err error
+				switch {
+				case stream:
+					firstRow, err = streamFeed(callCtx, streamer, userIDs, router.QueryFromContext(callCtx, limit))
+				case hasStats:
+					_, stats, err = reporter.QueryFeedStats(callCtx, userIDs, router.QueryFromContext(callCtx, limit))
+				default:
+					_, err = rtr.GetFeed(callCtx, userIDs, limit)
+				}
+				cancel()
 				dur := time.Since(start)
-				results <- result{latency: dur, err: err}
+				results <- result{latency: dur, firstRow: firstRow, err: err, stats: stats}
 			}
 		}()
 	}
@@ -154,13 +197,24 @@ func main() {
 
 	// Aggregate metrics: average latency, p95, and QPS.
 	var latencies []time.Duration
-	var errs int
+	var errs, partials int
+	var fetched, overFetched, rounds, hedged int
+	var firstRowSum time.Duration
 	for r := range results {
-		if r.err != nil {
+		var pe *router.PartialResultError
+		if errors.As(r.err, &pe) {
+			// Degraded but served: count it as a success and track it separately.
+			partials++
+		} else if r.err != nil {
 			errs++
 			continue
 		}
 		latencies = append(latencies, r.latency)
+		fetched += r.stats.Fetched
+		overFetched += r.stats.OverFetched
+		rounds += r.stats.Rounds
+		hedged += r.stats.Hedged
+		firstRowSum += r.firstRow
 	}
 	if len(latencies) == 0 {
 		log.Fatalf("no successful requests (errors=%d)", errs)
@@ -171,12 +225,55 @@ func main() {
 		sum += l
 	}
 	avg := time.Duration(int64(sum) / int64(len(latencies)))
-	p95 := latencies[int(float64(len(latencies))*0.95)-1]
+	p95 := percentile(latencies, 0.95)
+	p99 := percentile(latencies, 0.99)
 	qps := float64(len(latencies)) / totalDur.Seconds()
 
 	fmt.Printf("Mode: %s\n", mode)
 	fmt.Printf("Requests: %d, Concurrency: %d, Errors: %d\n", len(latencies), concurrency, errs)
+	if partial {
+		fmt.Printf("Partial results: %d\n", partials)
+	}
 	fmt.Printf("Avg latency: %s\n", avg.Truncate(time.Microsecond))
 	fmt.Printf("P95 latency: %s\n", p95.Truncate(time.Microsecond))
+	fmt.Printf("P99 latency: %s\n", p99.Truncate(time.Microsecond))
 	fmt.Printf("Total QPS: %.2f\n", qps)
+	if stream {
+		fmt.Printf("Avg time to first row: %s\n", (firstRowSum / time.Duration(len(latencies))).Truncate(time.Microsecond))
+	} else if hasStats {
+		n := float64(len(latencies))
+		fmt.Printf("Exact merge: %t\n", exact)
+		fmt.Printf("Avg rows fetched: %.1f, over-fetched: %.1f, rounds: %.2f\n",
+			float64(fetched)/n, float64(overFetched)/n, float64(rounds)/n)
+		if hedgeAfter > 0 || hedgePercentile > 0 {
+			fmt.Printf("Hedged shard queries: %d (%.1f%% of requests)\n", hedged, 100*float64(hedged)/n)
+		}
+	}
+}
+
+// percentile returns the p-th latency of a sorted slice (nearest rank).
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// streamFeed drains one feed through the streaming iterator and returns how long
+// the first row took to arrive.
+func streamFeed(ctx context.Context, s router.FeedStreamer, userIDs []int64, q router.FeedQuery) (time.Duration, error) {
+	start := time.Now()
+	it, err := s.IterFeed(ctx, userIDs, q)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	var firstRow time.Duration
+	for it.Next() {
+		if firstRow == 0 {
+			firstRow = time.Since(start)
+		}
+	}
+	return firstRow, it.Err()
 }
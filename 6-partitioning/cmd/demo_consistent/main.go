@@ -7,13 +7,15 @@ import (
 	"log"
 	"math/rand"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"partitioning/ready/internal/db"
+	"partitioning/ready/internal/model"
 	"partitioning/ready/internal/router"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -24,6 +26,20 @@ import (
 // 4) Migrate moved users' rows from old shard to the new owner (insert-select, then delete)
 // 5) Run the same benchmark using ring(4) and compare stats
 //
+// With -online, step 4 runs while the service is up: a router.Rebalancer moves the data
+// through dual-write, backfill, dual-read, cutover and cleanup (state in rebalance_state
+// on the baseline instance) while readers and writers keep using the router, and every
+// write is read back to check that no post goes missing during the move. With
+// -decommission=ID it then drains that shard off ring(4) the same way and closes its
+// pool, unless it is the baseline pool, which also holds the rebalance state.
+//
+// With -job, step 4 runs as a resumable migration job (router.JobStore, state in
+// migration_jobs on the baseline instance): one unit per moved hash range, several
+// moved at once, with the job's progress logged every second.
+//
+// With -pin=N, users 1..N are pinned to shard 0 in a directory (DirectoryRouter): they are
+// seeded there, read from there, and stay there when the ring grows.
+//
 // To avoid clashing with modulo-based example, we use a separate table name: posts_hash_ch
 func main() {
 	var users int
@@ -32,16 +48,54 @@ func main() {
 	var requests int
 	var limit int
 	var concurrency int
+	var pin int
+	var scheme string
+	var weightList string
+	var topologyFile string
+	var online bool
+	var decommission string
+	var job bool
+	var node int64
 	flag.IntVar(&users, "users", 2000, "number of users to seed/migrate")
 	flag.IntVar(&postsPerUser, "posts-per-user", 3, "posts per user (demo scale)")
 	flag.IntVar(&batch, "batch", 500, "insert batch size")
 	flag.IntVar(&requests, "requests", 300, "read requests per phase")
 	flag.IntVar(&limit, "limit", 50, "feed limit")
 	flag.IntVar(&concurrency, "concurrency", 20, "concurrent readers for benchmark")
+	flag.StringVar(&scheme, "partitioner", router.SchemeRing, "consistent hashing scheme: "+strings.Join(router.Schemes(), " | "))
+	flag.StringVar(&weightList, "weights", "", "comma-separated weights of shards 0..3 (ring, rendezvous); ring(3) uses the first three")
+	flag.StringVar(&topologyFile, "topology", "", "build rings as host-named ShardRings and write ring(3), then ring(4), to this topology file (ring only)")
+	flag.BoolVar(&online, "online", false, "migrate online with router.Rebalancer while reading and writing (ring only, no -pin)")
+	flag.StringVar(&decommission, "decommission", "", "with -online: afterwards drain this shard ID (e.g. postgres_shard_3) off ring(4) under load")
+	flag.BoolVar(&job, "job", false, "migrate as a resumable migration job by hash range (ring only, no -pin or -online)")
+	flag.IntVar(&pin, "pin", 0, "pin users 1..N to the first shard through the directory (0 = ring only)")
+	flag.Int64Var(&node, "node", -1, "node ID of this writer in generated post IDs, unique among writers (default: $NODE_ID)")
 	flag.Parse()
 
 	ctx := context.Background()
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	weights, err := router.ParseWeights(weightList)
+	if err != nil {
+		log.Fatalf("weights: %v", err)
+	}
+	if weights != nil && len(weights) != 4 {
+		log.Fatalf("weights: need 4 values (shards 0..3), got %d", len(weights))
+	}
+	if decommission != "" && !online {
+		log.Fatalf("-decommission needs -online")
+	}
+	if (online || job) && pin > 0 {
+		// Hash ranges move with every row in them, pinned or not.
+		log.Fatalf("-online and -job do not support -pin")
+	}
+	if online && job {
+		log.Fatalf("-online and -job are exclusive")
+	}
+	nodeID, err := router.NodeID(node)
+	if err != nil {
+		log.Fatalf("ids: %v", err)
+	}
+	ids := router.NewIDGenerator(nodeID)
 
 	// Pools: shards 0..2 from NewShardPools + baseline as shard #3
 	shardPools, err := db.NewShardPools(ctx)
@@ -56,6 +110,9 @@ func main() {
 	for _, p := range shardPools {
 		defer p.Close()
 	}
+	if len(shardPools) != 3 {
+		log.Fatalf("demo needs 3 shards, got %d (check SHARD_HOSTS)", len(shardPools))
+	}
 	pools3 := shardPools
 	pools4 := append(append([]*pgxpool.Pool{}, shardPools[0], shardPools[1], shardPools[2]), basePool)
 
@@ -63,33 +120,237 @@ func main() {
 	ensureDemoTables(ctx, append([]*pgxpool.Pool{}, pools4...))
 
 	// Build ring(3) and seed demo data
-	ring3 := router.NewRing(200)
-	ring3.Build([]int{0, 1, 2})
-	log.Printf("[phase:seed-3] users=%d postsPerUser=%d", users, postsPerUser)
-	if err := seedDemo(ctx, rng, ring3, pools3, users, postsPerUser, batch); err != nil {
+	var ring3 router.Partitioner
+	var shardRing3 *router.ShardRing
+	if topologyFile != "" || online || job {
+		// Slots follow the pool order, so the ShardRing indexes pools3 and pools4 directly.
+		if shardRing3, err = hostRing(db.ShardHosts()[:3], pools3, firstN(weights, 3)); err != nil {
+			log.Fatalf("ring: %v", err)
+		}
+		if topologyFile != "" {
+			writeTopology(topologyFile, shardRing3)
+		}
+		ring3 = shardRing3
+	} else if ring3, err = router.NewPartitioner(scheme, []int{0, 1, 2}, firstN(weights, 3), 200); err != nil {
+		log.Fatalf("partitioner: %v", err)
+	}
+	assignUsers(ring3, users)
+	reportPlacement("3 shards", ring3, 3, users)
+	ids3 := shardIDs(db.ShardHosts()[:3]...)
+	ch3 := &router.ConsistentHashRouter{Shards: pools3, ShardIDs: ids3, Partitioner: ring3, Table: "posts_hash_ch", IDs: ids}
+	var rtr3 demoRouter = ch3
+	var dir *router.Directory
+	if pin > 0 {
+		dir = pinUsers(ctx, basePool, pin, ids3[0])
+		rtr3 = &router.DirectoryRouter{ConsistentHashRouter: ch3, Directory: dir}
+	}
+	log.Printf("[phase:seed-3] users=%d postsPerUser=%d pinned=%d", users, postsPerUser, pin)
+	if err := seedDemo(ctx, rng, rtr3, users, postsPerUser, batch); err != nil {
 		log.Fatalf("seed 3 shards failed: %v", err)
 	}
 
 	// Benchmark reads on ring(3)
-	rtr3 := &router.ConsistentHashRouter{Shards: pools3, Ring: ring3, Table: "posts_hash_ch"}
 	log.Printf("[phase:bench-3] requests=%d concurrency=%d limit=%d", requests, concurrency, limit)
 	runBench(ctx, rng, rtr3, users, requests, concurrency, limit)
 
 	// Prepare ring(4) with baseline as shard #3
-	ring4 := router.NewRing(200)
-	ring4.Build([]int{0, 1, 2, 3})
+	var ring4 router.Partitioner
+	var shardRing4 *router.ShardRing
+	if shardRing3 != nil {
+		w := 1.0
+		if weights != nil {
+			w = weights[3]
+		}
+		if shardRing4, err = shardRing3.Add(db.BaselineHost, basePool, w); err != nil {
+			log.Fatalf("ring: %v", err)
+		}
+		ring4 = shardRing4
+	} else if ring4, err = router.NewPartitioner(scheme, []int{0, 1, 2, 3}, weights, 200); err != nil {
+		log.Fatalf("partitioner: %v", err)
+	}
+	assignUsers(ring4, users)
+	reportPlacement("4 shards", ring4, 4, users)
+
+	ids4 := append(append([]router.ShardID{}, ids3...), router.ShardID(db.BaselineHost))
+	ch4 := &router.ConsistentHashRouter{Shards: pools4, ShardIDs: ids4, Partitioner: ring4, Table: "posts_hash_ch", IDs: ids}
+	var rtr4 demoRouter = ch4
+	if dir != nil {
+		rtr4 = &router.DirectoryRouter{ConsistentHashRouter: ch4, Directory: dir}
+	}
+
+	reportDiff(ring3, ring4)
 
 	// Estimate moved keys and migrate
-	moved := estimateMoved(users, ring3, ring4)
+	moved, err := estimateMoved(ctx, users, rtr3, rtr4)
+	if err != nil {
+		log.Fatalf("estimate moved: %v", err)
+	}
 	log.Printf("[phase:migrate] estimated moved users: %.2f%% (%d/%d)", 100*float64(moved)/float64(users), moved, users)
-	if err := migrateUsers(ctx, ring3, ring4, pools4, users); err != nil {
+	var live *router.ConsistentHashRouter
+	if online {
+		live = migrateOnline(ctx, basePool, shardRing3, shardRing4, ids, users, limit, concurrency)
+		rtr4 = live
+	} else if job {
+		migrateJob(ctx, basePool, shardRing3, shardRing4)
+	} else if err := migrateUsers(ctx, rtr3, rtr4, pools4, users); err != nil {
 		log.Fatalf("migrate failed: %v", err)
 	}
+	if topologyFile != "" {
+		writeTopology(topologyFile, shardRing4)
+	}
 
 	// Benchmark reads on ring(4)
-	rtr4 := &router.ConsistentHashRouter{Shards: pools4, Ring: ring4, Table: "posts_hash_ch"}
 	log.Printf("[phase:bench-4] requests=%d concurrency=%d limit=%d", requests, concurrency, limit)
 	runBench(ctx, rng, rtr4, users, requests, concurrency, limit)
+
+	if decommission != "" {
+		// Shrink again: drain one shard of ring(4) while serving.
+		decommissionOnline(ctx, live, router.ShardID(decommission), users, limit, concurrency)
+		log.Printf("[phase:bench-decommissioned] requests=%d concurrency=%d limit=%d", requests, concurrency, limit)
+		runBench(ctx, rng, live, users, requests, concurrency, limit)
+	}
+}
+
+// hostRing builds a ShardRing over hosts, in order, so that slot i is pools[i].
+func hostRing(hosts []string, pools []*pgxpool.Pool, weights []float64) (*router.ShardRing, error) {
+	r := router.NewShardRing(200)
+	for i, h := range hosts {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		var err error
+		if r, err = r.Add(router.ShardID(h), pools[i], w); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// writeTopology stores r so that seed and benchmark can load the same placement.
+func writeTopology(path string, r *router.ShardRing) {
+	if err := router.WriteTopologyFile(path, r); err != nil {
+		log.Fatalf("topology: %v", err)
+	}
+	log.Printf("[topology] wrote %s: epoch %d, shards %v", path, r.Version(), r.Shards())
+}
+
+// assignUsers places users 1..users up front when p bounds loads, so both rings
+// measure load as assigned users.
+func assignUsers(p router.Partitioner, users int) {
+	b, ok := p.(*router.BoundedLoad)
+	if !ok {
+		return
+	}
+	ids := make([]int64, users)
+	for i := range ids {
+		ids[i] = int64(i + 1)
+	}
+	b.AssignUsers(ids)
+}
+
+func firstN(weights []float64, n int) []float64 {
+	if weights == nil {
+		return nil
+	}
+	return weights[:n]
+}
+
+// reportPlacement logs how users 1..users spread over shards and the average lookup cost,
+// to compare partitioners on the same keys.
+func reportPlacement(label string, p router.Partitioner, shards, users int) {
+	counts := make([]int, shards)
+	start := time.Now()
+	for u := 1; u <= users; u++ {
+		counts[p.Owner(router.HashUser(int64(u)))]++
+	}
+	perLookup := time.Since(start) / time.Duration(users)
+	shares := make([]string, shards)
+	for s, c := range counts {
+		shares[s] = fmt.Sprintf("%d:%.1f%%", s, 100*float64(c)/float64(users))
+	}
+	log.Printf("[placement %s] %T users per shard %s, lookup %s", label, p, strings.Join(shares, " "), perLookup)
+	if ring, ok := p.(interface{ Shares() []router.ShardShare }); ok {
+		for _, sh := range ring.Shares() {
+			log.Printf("[placement %s] shard %d weight=%g vnodes=%d keyspace expected=%.1f%% actual=%.1f%%",
+				label, sh.Shard, sh.Weight, sh.VNodes, 100*sh.Expected, 100*sh.Actual)
+		}
+	}
+}
+
+// reportDiff logs the hash ranges that change owner from old to next when both are
+// rings: the share of keyspace, hence of users, that the migration has to move.
+func reportDiff(old, next router.Partitioner) {
+	var moves []router.RangeMove
+	switch o := old.(type) {
+	case *router.Ring:
+		n, ok := next.(*router.Ring)
+		if !ok {
+			return
+		}
+		moves = o.Diff(n)
+	case *router.ShardRing:
+		n, ok := next.(*router.ShardRing)
+		if !ok {
+			return
+		}
+		moves = o.Diff(n)
+	default:
+		return
+	}
+	type route struct{ from, to int }
+	byRoute := make(map[route]float64)
+	var routes []route
+	for _, m := range moves {
+		r := route{m.From, m.To}
+		if _, seen := byRoute[r]; !seen {
+			routes = append(routes, r)
+		}
+		byRoute[r] += m.Fraction()
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].from < routes[j].from || routes[i].from == routes[j].from && routes[i].to < routes[j].to
+	})
+	log.Printf("[diff] %d hash ranges move, %.2f%% of the keyspace", len(moves), 100*router.MovedFraction(moves))
+	for _, r := range routes {
+		log.Printf("[diff] shard %d -> %d: %.2f%%", r.from, r.to, 100*byRoute[r])
+	}
+}
+
+// demoRouter is what the demo needs from a router: reads, writes and placement.
+type demoRouter interface {
+	router.FeedRouter
+	router.PostWriter
+	router.ShardLocator
+}
+
+// shardIDs names shards by host, as the topology file and directory pins do.
+func shardIDs(hosts ...string) []router.ShardID {
+	ids := make([]router.ShardID, len(hosts))
+	for i, h := range hosts {
+		ids[i] = router.ShardID(h)
+	}
+	return ids
+}
+
+// pinUsers pins users 1..n to shard in a directory stored on pool.
+func pinUsers(ctx context.Context, pool *pgxpool.Pool, n int, shard router.ShardID) *router.Directory {
+	const schema = `
+	CREATE TABLE IF NOT EXISTS shard_directory (
+	user_id BIGINT PRIMARY KEY,
+	shard TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT now()
+	);`
+	if _, err := pool.Exec(ctx, schema); err != nil {
+		log.Fatalf("ensure directory table: %v", err)
+	}
+	dir := router.NewDirectory(pool, router.DirectoryOptions{})
+	for u := 1; u <= n; u++ {
+		if err := dir.Pin(ctx, int64(u), shard); err != nil {
+			log.Fatalf("pin: %v", err)
+		}
+	}
+	return dir
 }
 
 func ensureDemoTables(ctx context.Context, pools []*pgxpool.Pool) {
@@ -99,7 +360,9 @@ func ensureDemoTables(ctx context.Context, pools []*pgxpool.Pool) {
 	user_id BIGINT NOT NULL,
 	created_at TIMESTAMP NOT NULL,
 	content TEXT NOT NULL
-	);`
+	);
+	ALTER TABLE posts_hash_ch ADD COLUMN IF NOT EXISTS user_hash BIGINT;
+	CREATE INDEX IF NOT EXISTS idx_posts_hash_ch_user_hash ON posts_hash_ch (user_hash, id);`
 	for i, p := range pools {
 		if _, err := p.Exec(ctx, schema); err != nil {
 			log.Fatalf("ensure table on shard %d: %v", i, err)
@@ -107,36 +370,12 @@ func ensureDemoTables(ctx context.Context, pools []*pgxpool.Pool) {
 	}
 }
 
-func seedDemo(ctx context.Context, rng *rand.Rand, ring *router.Ring, pools []*pgxpool.Pool, users, postsPerUser, batchSize int) error {
+// seedDemo writes postsPerUser posts for every user through the router's write path,
+// which batches them per ring owner.
+func seedDemo(ctx context.Context, rng *rand.Rand, rtr router.PostWriter, users, postsPerUser, batchSize int) error {
 	now := time.Now()
 	yearAgo := now.Add(-365 * 24 * time.Hour)
 
-	type shardBatch struct {
-		batch   *pgx.Batch
-		pending int
-	}
-	sb := make([]shardBatch, len(pools))
-	for i := range sb {
-		sb[i] = shardBatch{batch: &pgx.Batch{}}
-	}
-	flushShard := func(idx int) error {
-		if sb[idx].pending == 0 {
-			return nil
-		}
-		br := pools[idx].SendBatch(ctx, sb[idx].batch)
-		for i := 0; i < sb[idx].pending; i++ {
-			if _, err := br.Exec(); err != nil {
-				_ = br.Close()
-				return fmt.Errorf("exec shard %d: %w", idx, err)
-			}
-		}
-		if err := br.Close(); err != nil {
-			return fmt.Errorf("close shard %d: %w", idx, err)
-		}
-		sb[idx] = shardBatch{batch: &pgx.Batch{}, pending: 0}
-		return nil
-	}
-
 	makeContent := func() string {
 		const letters = "abcdefghijklmnopqrstuvwxyz"
 		b := make([]byte, 40)
@@ -146,64 +385,237 @@ func seedDemo(ctx context.Context, rng *rand.Rand, ring *router.Ring, pools []*p
 		return string(b)
 	}
 
+	batch := make([]model.Post, 0, batchSize)
 	for u := 1; u <= users; u++ {
-		owner := ring.Owner(router.HashUser(int64(u)))
 		for k := 0; k < postsPerUser; k++ {
 			delta := rng.Int63n(int64(now.Sub(yearAgo)))
-			createdAt := yearAgo.Add(time.Duration(delta))
-			sb[owner].batch.Queue(`INSERT INTO posts_hash_ch (user_id, created_at, content) VALUES ($1,$2,$3)`,
-				int64(u), createdAt, makeContent())
-			sb[owner].pending++
-			if sb[owner].pending >= batchSize {
-				if err := flushShard(owner); err != nil {
+			batch = append(batch, model.Post{
+				UserID:    int64(u),
+				CreatedAt: yearAgo.Add(time.Duration(delta)),
+				Content:   makeContent(),
+			})
+			if len(batch) >= batchSize {
+				if _, err := rtr.InsertPosts(ctx, batch); err != nil {
 					return err
 				}
+				batch = batch[:0]
 			}
 		}
 	}
-	for i := range sb {
-		if err := flushShard(i); err != nil {
-			return err
-		}
+	if _, err := rtr.InsertPosts(ctx, batch); err != nil {
+		return err
 	}
 	return nil
 }
 
-func estimateMoved(users int, oldRing, newRing *router.Ring) int {
+func estimateMoved(ctx context.Context, users int, oldRtr, newRtr router.ShardLocator) (int, error) {
 	var moved int
 	for u := 1; u <= users; u++ {
-		key := router.HashUser(int64(u))
-		if oldRing.Owner(key) != newRing.Owner(key) {
+		old, new, err := owners(ctx, int64(u), oldRtr, newRtr)
+		if err != nil {
+			return 0, err
+		}
+		if old != new {
 			moved++
 		}
 	}
-	return moved
+	return moved, nil
 }
 
-func migrateUsers(ctx context.Context, oldRing, newRing *router.Ring, pools []*pgxpool.Pool, users int) error {
-	// For each user that changes ownership, move rows from old shard to new shard.
+// owners returns the shard of userID before and after the topology change.
+func owners(ctx context.Context, userID int64, oldRtr, newRtr router.ShardLocator) (int, int, error) {
+	old, err := oldRtr.ShardOf(ctx, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	new, err := newRtr.ShardOf(ctx, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return old, new, nil
+}
+
+// migrateUsers moves the posts of every user that changes owner to its new shard with
+// router.MoveUser, which verifies the copy before deleting from the old shard.
+// Pinned users keep their shard on both sides, so they never move.
+func migrateUsers(ctx context.Context, oldRtr, newRtr router.ShardLocator, pools []*pgxpool.Pool, users int) error {
+	var rows int64
+	start := time.Now()
 	for u := 1; u <= users; u++ {
-		key := router.HashUser(int64(u))
-		old := oldRing.Owner(key)
-		new := newRing.Owner(key)
+		old, new, err := owners(ctx, int64(u), oldRtr, newRtr)
+		if err != nil {
+			return err
+		}
 		if old == new {
 			continue
 		}
-		// Insert into new then delete from old to avoid losing data on failure.
-		if _, err := pools[new].Exec(ctx,
-			`INSERT INTO posts_hash_ch (user_id, created_at, content)
-			 SELECT user_id, created_at, content FROM posts_hash_ch WHERE user_id = $1`, int64(u)); err != nil {
-			return fmt.Errorf("insert new shard %d user %d: %w", new, u, err)
-		}
-		if _, err := pools[old].Exec(ctx,
-			`DELETE FROM posts_hash_ch WHERE user_id = $1`, int64(u)); err != nil {
-			return fmt.Errorf("delete old shard %d user %d: %w", old, u, err)
+		st, err := router.MoveUser(ctx, pools[old], pools[new], "posts_hash_ch", int64(u), 1000)
+		if err != nil {
+			return fmt.Errorf("move user %d from shard %d to %d: %w", u, old, new, err)
 		}
+		rows += st.Rows
 	}
+	log.Printf("[phase:migrate] moved %d rows in %s", rows, time.Since(start).Round(time.Millisecond))
 	return nil
 }
 
-func runBench(ctx context.Context, rng *rand.Rand, rtr *router.ConsistentHashRouter, users, requests, concurrency, limit int) {
+// migrateOnline moves the demo table from ring3 to ring4 with a router.Rebalancer while
+// traffic keeps using a router that follows the rebalance state (see underLoad). It
+// returns that router, now stable on ring4.
+func migrateOnline(ctx context.Context, base *pgxpool.Pool, ring3, ring4 *router.ShardRing, ids *router.IDGenerator, users, limit, concurrency int) *router.ConsistentHashRouter {
+	const schema = `
+	CREATE TABLE IF NOT EXISTS rebalance_state (
+	name TEXT PRIMARY KEY,
+	phase TEXT NOT NULL,
+	from_ring JSONB NOT NULL,
+	to_ring JSONB,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`
+	if _, err := base.Exec(ctx, schema); err != nil {
+		log.Fatalf("ensure rebalance table: %v", err)
+	}
+	resolve := func(id router.ShardID) (*pgxpool.Pool, error) {
+		if p := ring4.Pool(id); p != nil {
+			return p, nil
+		}
+		return nil, fmt.Errorf("no pool for shard %s", id)
+	}
+	store := router.NewRebalanceStore(base, resolve, router.RebalanceOptions{Name: "posts_hash_ch", Poll: 200 * time.Millisecond})
+	if err := store.Init(ctx, ring3); err != nil {
+		log.Fatalf("rebalance: %v", err)
+	}
+	rtr := &router.ConsistentHashRouter{Rebalance: store, Table: "posts_hash_ch", IDs: ids}
+	underLoad(ctx, rtr, "migrate-online", users, limit, concurrency, func(rb *router.Rebalancer) error {
+		return rb.Run(ctx, ring4)
+	})
+	return rtr
+}
+
+// migrateJob moves the demo table from ring3 to ring4 as a migration job with a new
+// name, 4 hash ranges at a time, and logs the job's progress until it is done.
+func migrateJob(ctx context.Context, base *pgxpool.Pool, ring3, ring4 *router.ShardRing) {
+	if err := router.EnsureJobTables(ctx, base); err != nil {
+		log.Fatalf("%v", err)
+	}
+	resolve := func(id router.ShardID) (*pgxpool.Pool, error) {
+		if p := ring4.Pool(id); p != nil {
+			return p, nil
+		}
+		return nil, fmt.Errorf("no pool for shard %s", id)
+	}
+	jobs := router.NewJobStore(base, resolve, router.JobOptions{})
+	// Every run reseeds the demo table, so it gets a job of its own.
+	name := fmt.Sprintf("demo-%d", time.Now().Unix())
+	spec := router.JobSpec{Name: name, Table: "posts_hash_ch", From: ring3, To: ring4, Concurrency: 4, BatchSize: 1000}
+	if err := jobs.Create(ctx, spec); err != nil {
+		log.Fatalf("job: %v", err)
+	}
+	report := func() {
+		if p, err := jobs.Progress(ctx, name); err == nil {
+			log.Printf("[phase:migrate-job] %s: %s, pending=%d copying=%d verifying=%d done=%d failed=%d, %d rows",
+				name, p.Status, p.Units[router.UnitPending], p.Units[router.UnitCopying], p.Units[router.UnitVerifying],
+				p.Units[router.UnitDone], p.Units[router.UnitFailed], p.Rows)
+		}
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-t.C:
+				report()
+			}
+		}
+	}()
+	start := time.Now()
+	err := jobs.Run(runCtx, name)
+	stop()
+	report()
+	if err != nil {
+		log.Fatalf("job: %v (see go run ./cmd/migrate -job=%s -status)", err, name)
+	}
+	log.Printf("[phase:migrate-job] done in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// decommissionOnline drains shard id off the ring rtr follows, under traffic, and
+// closes its pool.
+func decommissionOnline(ctx context.Context, rtr *router.ConsistentHashRouter, id router.ShardID, users, limit, concurrency int) {
+	underLoad(ctx, rtr, "decommission", users, limit, concurrency, func(rb *router.Rebalancer) error {
+		ring, err := rb.Decommission(ctx, id)
+		if err == nil {
+			log.Printf("[phase:decommission] %s drained; shards %v (epoch %d)", id, ring.Shards(), ring.Version())
+		}
+		return err
+	})
+}
+
+// underLoad runs move with a router.Rebalancer over rtr's rebalance state while
+// concurrency workers keep writing posts through rtr and reading them back, counting
+// posts missing from (or duplicated in) the author's feed right after the write.
+func underLoad(ctx context.Context, rtr *router.ConsistentHashRouter, label string, users, limit, concurrency int, move func(*router.Rebalancer) error) {
+	trafficCtx, stopTraffic := context.WithCancel(ctx)
+	defer stopTraffic()
+	go rtr.Rebalance.Watch(trafficCtx)
+	var writes, reads, missing, errs atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for trafficCtx.Err() == nil {
+				u := 1 + rng.Int63n(int64(users))
+				p, err := rtr.InsertPost(trafficCtx, model.Post{UserID: u, Content: label})
+				if err != nil {
+					if trafficCtx.Err() == nil {
+						errs.Add(1)
+					}
+					continue
+				}
+				writes.Add(1)
+				feed, err := rtr.GetFeed(trafficCtx, []int64{u}, limit)
+				if err != nil {
+					if trafficCtx.Err() == nil {
+						errs.Add(1)
+					}
+					continue
+				}
+				reads.Add(1)
+				if !containsPost(feed, p.ID) {
+					missing.Add(1)
+				}
+			}
+		}(time.Now().UnixNano() + int64(w))
+	}
+
+	rb := &router.Rebalancer{Store: rtr.Rebalance, Table: "posts_hash_ch", Settle: time.Second, OnPhase: func(st *router.RebalanceState) {
+		log.Printf("[phase:%s] %s (writes=%d reads=%d missing=%d errs=%d)", label, st.Phase, writes.Load(), reads.Load(), missing.Load(), errs.Load())
+	}}
+	start := time.Now()
+	if err := move(rb); err != nil {
+		log.Fatalf("%s: %v", label, err)
+	}
+	stopTraffic()
+	wg.Wait()
+	log.Printf("[phase:%s] done in %s: writes=%d reads=%d missing=%d errs=%d",
+		label, time.Since(start).Round(time.Millisecond), writes.Load(), reads.Load(), missing.Load(), errs.Load())
+}
+
+// containsPost reports whether feed holds the post with id exactly once.
+func containsPost(feed []model.Post, id int64) bool {
+	n := 0
+	for _, p := range feed {
+		if p.ID == id {
+			n++
+		}
+	}
+	return n == 1
+}
+
+func runBench(ctx context.Context, rng *rand.Rand, rtr router.FeedRouter, users, requests, concurrency, limit int) {
 	type result struct {
 		d time.Duration
 		e error
@@ -0,0 +1,398 @@
+// Migrate tool: moves posts between shards by hash range (the user_hash column), so
+// no user IDs have to be enumerated. Rings come from topology files (router.ShardRing).
+// - -from=OLD -to=NEW moves every hash range whose owner changes (ShardRing.Diff)
+// - -repair -to=NEW moves rows found on a shard that does not own their range under NEW
+// - -backfill first fills user_hash for rows written before the column existed
+// - -online -from=OLD -to=NEW moves online with router.Rebalancer (state in rebalance_state)
+// - -decommission=ID -from=OLD drains shard ID online and writes the ring without it to -to
+// - -split=SRC -new=ID -fraction=F -from=OLD -to=NEW gives new shard ID a fraction F of SRC's ranges
+// - -job=NAME -from=OLD -to=NEW moves as a resumable job in migration_jobs (-pause, -resume, -status)
+// - -plan=FILE runs a plan saved by -from=OLD -to=NEW -dry-run -plan=FILE (router.RebalancePlan)
+// With -dry-run it only counts the rows each step would move; -from -to estimates them
+// from a -sample of every shard and prints the per-shard result.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"partitioning/ready/internal/router"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func main() {
+	var fromFile string
+	var toFile string
+	var table string
+	var batch int
+	var backfill bool
+	var repair bool
+	var dryRun bool
+	var online bool
+	var settle time.Duration
+	var rate int
+	var decommission string
+	var split string
+	var newShard string
+	var fraction float64
+	var planFile string
+	var sample float64
+	var jobName string
+	var concurrency int
+	var pause bool
+	var resume bool
+	var status bool
+	flag.StringVar(&fromFile, "from", "", "topology file the data is placed by now")
+	flag.StringVar(&toFile, "to", "", "topology file to place the data by")
+	flag.StringVar(&table, "table", "posts_hash", "sharded table (posts_hash or posts_hash_ch)")
+	flag.IntVar(&batch, "batch", 1000, "rows per copy/delete batch")
+	flag.BoolVar(&backfill, "backfill", false, "fill user_hash where it is NULL before moving")
+	flag.BoolVar(&repair, "repair", false, "move rows stored outside their owner under -to")
+	flag.BoolVar(&dryRun, "dry-run", false, "count (or, for -from -to, estimate) rows to move without moving them")
+	flag.BoolVar(&online, "online", false, "move -from to -to online, through the phases of router.Rebalancer (resumes a rebalance in progress)")
+	flag.DurationVar(&settle, "settle", 3*time.Second, "with -online: wait after each phase change so every router follows it")
+	flag.IntVar(&rate, "rate", 0, "with -online and -decommission: max rows per second per range; with -job: for the whole job (0 = unlimited)")
+	flag.StringVar(&decommission, "decommission", "", "shard ID to drain and take off the -from ring (online)")
+	flag.StringVar(&split, "split", "", "shard ID of the -from ring to split onto -new")
+	flag.StringVar(&newShard, "new", "", "with -split: ID of the new shard")
+	flag.Float64Var(&fraction, "fraction", 0.5, "with -split: fraction of the keyspace of -split that -new takes over")
+	flag.StringVar(&planFile, "plan", "", "with -dry-run: save the plan of -from -> -to here; otherwise: run this plan")
+	flag.Float64Var(&sample, "sample", 1, "with -dry-run -from -to: percent of every shard to sample (100 = count every row)")
+	flag.StringVar(&jobName, "job", "", "move -from -to (or -plan) as this resumable job; alone: continue the job")
+	flag.IntVar(&concurrency, "concurrency", 1, "with -job: ranges moved at the same time")
+	flag.BoolVar(&pause, "pause", false, "with -job: pause the running job")
+	flag.BoolVar(&resume, "resume", false, "with -job: resume a paused or failed job, retrying its failed ranges")
+	flag.BoolVar(&status, "status", false, "with -job: print the state of the job")
+	flag.Parse()
+
+	ctx := context.Background()
+	topo, err := router.OpenTopology(ctx)
+	if err != nil {
+		log.Fatalf("connect: %v", err)
+	}
+	defer topo.Close()
+
+	var from, to *router.ShardRing
+	if planFile != "" && !dryRun {
+		if fromFile != "" || toFile != "" || split != "" || decommission != "" {
+			log.Fatalf("-plan without -dry-run runs the plan's rings; drop -from, -to, -split and -decommission")
+		}
+		plan, err := router.ReadPlanFile(planFile)
+		if err != nil {
+			log.Fatalf("plan: %v", err)
+		}
+		if plan.Table != table {
+			log.Fatalf("plan %s is for table %s, not %s (see -table)", planFile, plan.Table, table)
+		}
+		if from, to, err = plan.Rings(topo.ShardPool); err != nil {
+			log.Fatalf("plan %s: %v", planFile, err)
+		}
+		rows, bytes := plan.Moved()
+		log.Printf("[plan] %s (%s): epoch %d -> %d, %d ranges, ~%d rows, ~%s", planFile, plan.CreatedAt.Format(time.RFC3339), from.Version(), to.Version(), len(plan.Moves), rows, sizeOf(bytes))
+	}
+	if fromFile != "" {
+		if from, err = router.ReadTopologyFile(fromFile, topo.ShardPool); err != nil {
+			log.Fatalf("from: %v", err)
+		}
+	}
+	if toFile != "" && decommission == "" && split == "" {
+		if to, err = router.ReadTopologyFile(toFile, topo.ShardPool); err != nil {
+			log.Fatalf("to: %v", err)
+		}
+	}
+	if (from != nil && decommission == "" && split == "" || repair) && to == nil {
+		log.Fatalf("-to is required with -from and -repair")
+	}
+	if (pause || resume || status) && jobName == "" {
+		log.Fatalf("-pause, -resume and -status need -job")
+	}
+	if jobName != "" && online {
+		log.Fatalf("-job moves offline; drop -online")
+	}
+	if decommission != "" && from == nil {
+		log.Fatalf("-decommission needs -from")
+	}
+	if split != "" {
+		if from == nil || toFile == "" || newShard == "" {
+			log.Fatalf("-split needs -new, -from and -to")
+		}
+		to = splitShard(ctx, topo, table, from, router.ShardID(split), router.ShardID(newShard), fraction, toFile, dryRun)
+	}
+	if planFile != "" && dryRun && (from == nil || decommission != "") {
+		log.Fatalf("-plan with -dry-run needs -from and -to")
+	}
+
+	start := time.Now()
+	if backfill {
+		pools := topo.Shards
+		if to != nil {
+			pools = livePools(to)
+		}
+		for i, p := range pools {
+			if dryRun {
+				log.Printf("[backfill] shard %d: skipped (dry run)", i)
+				continue
+			}
+			n, err := router.BackfillUserHash(ctx, p, table, batch)
+			if err != nil {
+				log.Fatalf("backfill shard %d: %v", i, err)
+			}
+			log.Printf("[backfill] shard %d: %d rows", i, n)
+		}
+	}
+	if decommission != "" {
+		drainShard(ctx, topo, table, from, router.ShardID(decommission), toFile, batch, rate, settle, dryRun)
+		from = nil
+	}
+	if jobName != "" && !dryRun {
+		runJob(ctx, topo, table, jobName, from, to, batch, rate, concurrency, pause, resume, status)
+		from = nil
+	}
+	if online && !dryRun && from != nil {
+		if to == nil {
+			log.Fatalf("-online needs -from and -to")
+		}
+		rb, err := newRebalancer(ctx, topo, table, from, batch, rate, settle)
+		if err != nil {
+			log.Fatalf("online: %v", err)
+		}
+		if err := rb.Run(ctx, to); err != nil {
+			log.Fatalf("online: %v", err)
+		}
+		from = nil
+	}
+	if from != nil && dryRun {
+		plan, err := router.PlanRebalance(ctx, from, to, table, sample)
+		if err != nil {
+			log.Fatalf("plan: %v", err)
+		}
+		printPlan(plan)
+		if planFile != "" {
+			if err := router.WritePlanFile(planFile, plan); err != nil {
+				log.Fatalf("plan: %v", err)
+			}
+			log.Printf("[plan] wrote %s; run it with -plan=%s", planFile, planFile)
+		}
+		from = nil
+	}
+	if from != nil {
+		moves := from.Diff(to)
+		log.Printf("[migrate] epoch %d -> %d: %d ranges, %.2f%% of the keyspace", from.Version(), to.Version(), len(moves), 100*router.MovedFraction(moves))
+		var total int64
+		for _, m := range moves {
+			n, err := moveOrCount(ctx, from.Pools()[m.From], to.Pools()[m.To], table, m.HashRange, batch, dryRun)
+			if err != nil {
+				log.Fatalf("move %s -> %s: %v", from.ID(m.From), to.ID(m.To), err)
+			}
+			total += n
+		}
+		log.Printf("[migrate] %d rows %s", total, verb(dryRun))
+	}
+	if repair {
+		var total int64
+		for _, id := range to.Shards() {
+			slot, _ := to.Slot(id)
+			for _, r := range to.Ranges() {
+				if r.Shard == slot {
+					continue
+				}
+				n, err := moveOrCount(ctx, to.Pool(id), to.Pools()[r.Shard], table, r.HashRange, batch, dryRun)
+				if err != nil {
+					log.Fatalf("repair %s -> %s: %v", id, to.ID(r.Shard), err)
+				}
+				if n > 0 {
+					log.Printf("[repair] %s -> %s [%d, %d): %d rows %s", id, to.ID(r.Shard), r.Start, r.End, n, verb(dryRun))
+				}
+				total += n
+			}
+		}
+		log.Printf("[repair] %d misplaced rows %s", total, verb(dryRun))
+	}
+	log.Printf("done in %s", time.Since(start).Truncate(time.Millisecond))
+}
+
+// newRebalancer returns a router.Rebalancer over the rebalance state of table on the
+// baseline instance. A stable state is first reset to from; a rebalance in progress is
+// left as is, so Run resumes it.
+func newRebalancer(ctx context.Context, topo router.Topology, table string, from *router.ShardRing, batch, rate int, settle time.Duration) (*router.Rebalancer, error) {
+	store := router.NewRebalanceStore(topo.Baseline, topo.ShardPool, router.RebalanceOptions{Name: table})
+	if st, err := store.Refresh(ctx); err != nil || st.Phase == router.PhaseStable {
+		if err := store.Init(ctx, from); err != nil {
+			return nil, err
+		}
+	}
+	return &router.Rebalancer{Store: store, Table: table, BatchSize: batch, RowsPerSecond: rate, Settle: settle, Keep: []*pgxpool.Pool{topo.Baseline}, OnPhase: func(st *router.RebalanceState) {
+		if st.To != nil {
+			log.Printf("[online] %s: epoch %d -> %d", st.Phase, st.From.Version(), st.To.Version())
+		} else {
+			log.Printf("[online] %s: epoch %d", st.Phase, st.From.Version())
+		}
+	}}, nil
+}
+
+// runJob creates job name moving table from ring from to ring to, if from is set, and
+// then pauses, reports, or (after resuming it, if asked) runs the job.
+func runJob(ctx context.Context, topo router.Topology, table, name string, from, to *router.ShardRing, batch, rate, concurrency int, pause, resume, status bool) {
+	if err := router.EnsureJobTables(ctx, topo.Baseline); err != nil {
+		log.Fatalf("job: %v", err)
+	}
+	jobs := router.NewJobStore(topo.Baseline, topo.ShardPool, router.JobOptions{})
+	switch {
+	case pause:
+		if err := jobs.Pause(ctx, name); err != nil {
+			log.Fatalf("job: %v", err)
+		}
+		log.Printf("[job] %s: pausing (the running migrate stops within a second)", name)
+		return
+	case status:
+		printJob(ctx, jobs, name)
+		return
+	}
+	if from != nil {
+		spec := router.JobSpec{Name: name, Table: table, From: from, To: to, RowsPerSecond: rate, Concurrency: concurrency, BatchSize: batch}
+		if err := jobs.Create(ctx, spec); err != nil {
+			log.Fatalf("job: %v", err)
+		}
+	}
+	if resume {
+		if err := jobs.Resume(ctx, name); err != nil {
+			log.Fatalf("job: %v", err)
+		}
+	}
+	err := jobs.Run(ctx, name)
+	printJob(ctx, jobs, name)
+	if errors.Is(err, router.ErrJobPaused) {
+		log.Printf("[job] %s: paused; continue with -job=%s -resume", name, name)
+		return
+	}
+	if err != nil {
+		log.Fatalf("job: %v", err)
+	}
+}
+
+// printJob logs the state of job name and the error of every failed unit.
+func printJob(ctx context.Context, jobs *router.JobStore, name string) {
+	p, err := jobs.Progress(ctx, name)
+	if err != nil {
+		log.Fatalf("job: %v", err)
+	}
+	log.Printf("[job] %s: %s, %s epoch %d -> %d, units pending=%d copying=%d verifying=%d done=%d failed=%d, %d rows moved",
+		p.Name, p.Status, p.Table, p.FromEpoch, p.ToEpoch, p.Units[router.UnitPending], p.Units[router.UnitCopying],
+		p.Units[router.UnitVerifying], p.Units[router.UnitDone], p.Units[router.UnitFailed], p.Rows)
+	for _, e := range p.Errors {
+		log.Printf("[job] %s: %s", name, e)
+	}
+}
+
+// drainShard decommissions shard id of ring from: it moves the shard's ranges to their
+// new owners online and writes the resulting ring to toFile, if set. On a dry run it
+// only counts the rows to move.
+func drainShard(ctx context.Context, topo router.Topology, table string, from *router.ShardRing, id router.ShardID, toFile string, batch, rate int, settle time.Duration, dryRun bool) {
+	if dryRun {
+		to, err := from.Remove(id)
+		if err != nil {
+			log.Fatalf("decommission: %v", err)
+		}
+		moves := from.Diff(to)
+		var total int64
+		for _, m := range moves {
+			n, err := router.CountRange(ctx, from.Pool(id), table, m.HashRange)
+			if err != nil {
+				log.Fatalf("decommission: %v", err)
+			}
+			total += n
+		}
+		log.Printf("[decommission] %s: %d ranges, %.2f%% of the keyspace, %d rows to move", id, len(moves), 100*router.MovedFraction(moves), total)
+		return
+	}
+	rb, err := newRebalancer(ctx, topo, table, from, batch, rate, settle)
+	if err != nil {
+		log.Fatalf("decommission: %v", err)
+	}
+	to, err := rb.Decommission(ctx, id)
+	if to != nil && toFile != "" {
+		if werr := router.WriteTopologyFile(toFile, to); werr != nil {
+			log.Fatalf("decommission: %v", werr)
+		}
+		log.Printf("[decommission] wrote %s: epoch %d, shards %v", toFile, to.Version(), to.Shards())
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	log.Printf("[decommission] %s drained and off the ring", id)
+}
+
+// splitShard returns ring from with shard id taking fraction of the ranges of shard
+// src (ShardRing.Split) and logs the plan: every range moves from src to id, so no
+// other shard is touched. It writes the ring to toFile, except on a dry run.
+func splitShard(ctx context.Context, topo router.Topology, table string, from *router.ShardRing, src, id router.ShardID, fraction float64, toFile string, dryRun bool) *router.ShardRing {
+	pool, err := topo.ShardPool(id)
+	if err != nil {
+		log.Fatalf("split: %v", err)
+	}
+	to, err := from.Split(src, id, pool, fraction)
+	if err != nil {
+		log.Fatalf("split: %v", err)
+	}
+	moves := from.Diff(to)
+	log.Printf("[split] %s -> %s: %d ranges, %.2f%% of the keyspace (weights %.2f / %.2f)",
+		src, id, len(moves), 100*router.MovedFraction(moves), to.Weight(src), to.Weight(id))
+	if dryRun {
+		return to
+	}
+	if err := router.WriteTopologyFile(toFile, to); err != nil {
+		log.Fatalf("split: %v", err)
+	}
+	log.Printf("[split] wrote %s: epoch %d, shards %v", toFile, to.Version(), to.Shards())
+	return to
+}
+
+// printPlan logs every range of plan and the size of every shard before and after.
+func printPlan(plan *router.RebalancePlan) {
+	for _, m := range plan.Moves {
+		log.Printf("[plan] [%d, %d) %s -> %s: ~%d rows, ~%s", m.Start, m.End, m.From, m.To, m.Rows, sizeOf(m.Bytes))
+	}
+	rows, bytes := plan.Moved()
+	log.Printf("[plan] %s, epoch %d -> %d: %d ranges, ~%d rows, ~%s (%g%% sample)", plan.Table, plan.From.Epoch, plan.To.Epoch, len(plan.Moves), rows, sizeOf(bytes), plan.SamplePercent)
+	for _, sh := range plan.Shards {
+		log.Printf("[plan] %-20s rows ~%d -> ~%d (%.1f%% -> %.1f%%), %s -> %s, keyspace %.1f%%",
+			sh.ID, sh.Rows, sh.RowsAfter, 100*sh.Share, 100*sh.ShareAfter, sizeOf(sh.Bytes), sizeOf(sh.BytesAfter), 100*sh.Keyspace)
+		if sh.Unhashed > 0 {
+			log.Printf("[plan] %-20s ~%d rows without user_hash are not moved (run -backfill)", sh.ID, sh.Unhashed)
+		}
+	}
+}
+
+// sizeOf formats a byte count in MiB.
+func sizeOf(bytes int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(bytes)/(1<<20))
+}
+
+// moveOrCount moves the rows of r from src to dst, or only counts them on a dry run.
+func moveOrCount(ctx context.Context, src, dst *pgxpool.Pool, table string, r router.HashRange, batch int, dryRun bool) (int64, error) {
+	if dryRun {
+		return router.CountRange(ctx, src, table, r)
+	}
+	return router.MoveRange(ctx, src, dst, table, r, batch)
+}
+
+// livePools returns the pools of the shards on r.
+func livePools(r *router.ShardRing) []*pgxpool.Pool {
+	var pools []*pgxpool.Pool
+	for _, id := range r.Shards() {
+		pools = append(pools, r.Pool(id))
+	}
+	return pools
+}
+
+func verb(dryRun bool) string {
+	if dryRun {
+		return "to move"
+	}
+	return "moved"
+}
@@ -1,20 +1,26 @@
 // Seed tool: populates databases for the workshop.
 // - mode=baseline inserts into a single posts table (no partitioning)
-// - mode=hash inserts into three shard databases based on user_id % 3
+// - mode=range inserts through the posts_range parent (Postgres picks the monthly partition)
+// - mode=hash inserts into the shard databases (SHARD_HOSTS, three by default) by jump hash of user_id
+// - mode=hash-consistent inserts into the shards owning each user on the consistent hashing ring
+// - mode=directory is hash-consistent, except for users pinned in shard_directory
+// Routing is done by the router's write path, so seeded rows land where readers look for them.
+// A posts_hash seeded by the older user_id % 3 rule must be truncated first (see README).
+// Sharded modes assign post IDs in the application and need a node ID (-node or NODE_ID)
+// that no other concurrent writer uses.
 package main
 
 import (
 	"context"
 	"flag"
-	"fmt"
 	"log"
 	"math/rand"
 	"strings"
 	"time"
 
 	"partitioning/ready/internal/db"
-
-	"github.com/jackc/pgx/v5"
+	"partitioning/ready/internal/model"
+	"partitioning/ready/internal/router"
 )
 
 func main() {
@@ -24,119 +30,73 @@ func main() {
 	var numPosts int
 	var batchSize int
 	var contentSize int
-	flag.StringVar(&mode, "mode", "baseline", "seed mode: baseline | hash")
+	var scheme string
+	var weightList string
+	var epsilon float64
+	var topologyFile string
+	var node int64
+	flag.StringVar(&mode, "mode", "baseline", "seed mode: "+strings.Join(router.Modes(), " | "))
 	flag.IntVar(&numUsers, "users", 10000, "number of users")
 	flag.IntVar(&numPosts, "posts", 1000000, "number of posts to insert")
 	flag.IntVar(&batchSize, "batch", 1000, "insert batch size")
 	flag.IntVar(&contentSize, "content-size", 80, "post content size (bytes/characters)")
+	flag.StringVar(&scheme, "partitioner", router.SchemeRing, "consistent hashing scheme for hash-consistent and directory modes: "+strings.Join(router.Schemes(), " | "))
+	flag.StringVar(&weightList, "weights", "", "comma-separated shard weights for -partitioner=ring|rendezvous, e.g. 1,1,2")
+	flag.Float64Var(&epsilon, "epsilon", router.DefaultBoundedEpsilon, "load slack for -partitioner=bounded: a shard takes at most (1+epsilon) x its share of users")
+	flag.StringVar(&topologyFile, "topology", "", "topology file (JSON ShardRing) placing users for hash-consistent and directory modes; cannot be combined with -weights or another -partitioner")
+	flag.Int64Var(&node, "node", -1, "node ID of this writer in generated post IDs, unique among writers (default: $NODE_ID); required by sharded modes")
 	flag.Parse()
 
 	ctx := context.Background()
 	// Local RNG instance (no global rand.Seed); keeps randomness explicit and testable.
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	start := time.Now()
-	switch mode {
-	case "baseline":
-		// Single-DB insert path
-		if err := seedBaseline(ctx, r, numUsers, numPosts, batchSize, contentSize); err != nil {
-			log.Fatalf("seed baseline failed: %v", err)
-		}
-	case "hash":
-		// Multi-DB sharded insert path
-		if err := seedHash(ctx, r, numUsers, numPosts, batchSize, contentSize); err != nil {
-			log.Fatalf("seed hash failed: %v", err)
-		}
-	default:
-		log.Fatalf("unknown mode: %s", mode)
-	}
-	log.Printf("done in %s", time.Since(start).Truncate(time.Millisecond))
-}
-
-// seedBaseline inserts posts into a single table using batched inserts for throughput.
-func seedBaseline(ctx context.Context, r *rand.Rand, numUsers, numPosts, batchSize, contentSize int) error {
-	pool, err := db.NewBaselinePool(ctx)
+	topo, err := router.OpenTopology(ctx)
 	if err != nil {
-		return err
+		log.Fatalf("connect: %v", err)
 	}
-	defer pool.Close()
-
-	log.Printf("seeding baseline: users=%d posts=%d batch=%d", numUsers, numPosts, batchSize)
-
-	// Generate timestamps uniformly across the last year.
-	now := time.Now()
-	yearAgo := now.Add(-365 * 24 * time.Hour)
-
-	// Small helper to produce synthetic post content of fixed size.
-	makeContent := func() string {
-		var b strings.Builder
-		for i := 0; i < contentSize; i++ {
-			b.WriteByte(byte('a' + r.Intn(26)))
+	defer topo.Close()
+	switch mode {
+	case router.ModeHash, router.ModeConsistent, router.ModeDirectory:
+		n, err := router.NodeID(node)
+		if err != nil {
+			log.Fatalf("ids: %v", err)
 		}
-		return b.String()
+		topo.IDs = router.NewIDGenerator(n)
 	}
-
-	// Use pgx.Batch to group many INSERTs per round-trip.
-	batch := &pgx.Batch{}
-	pending := 0
-	// flush sends the accumulated INSERTs to Postgres and resets the batch.
-	flush := func() error {
-		if pending == 0 {
-			return nil
-		}
-		br := pool.SendBatch(ctx, batch)
-		for i := 0; i < pending; i++ {
-			if _, err := br.Exec(); err != nil {
-				_ = br.Close()
-				return fmt.Errorf("batch exec: %w", err)
-			}
-		}
-		if err := br.Close(); err != nil {
-			return fmt.Errorf("batch close: %w", err)
-		}
-		batch = &pgx.Batch{}
-		pending = 0
-		return nil
+	topo.Partitioner = scheme
+	if topo.Weights, err = router.ParseWeights(weightList); err != nil {
+		log.Fatalf("weights: %v", err)
 	}
-
-	for i := 0; i < numPosts; i++ {
-		// Random user among [1..numUsers]
-		userID := 1 + r.Int63n(int64(numUsers))
-		// Uniform sampling over last year for created_at
-		delta := r.Int63n(int64(now.Sub(yearAgo)))
-		createdAt := yearAgo.Add(time.Duration(delta))
-		content := makeContent()
-		batch.Queue(`INSERT INTO posts (user_id, created_at, content) VALUES ($1,$2,$3)`, userID, createdAt, content)
-		pending++
-		if pending >= batchSize {
-			if err := flush(); err != nil {
-				return err
-			}
+	topo.Bounded = router.BoundedOptions{Epsilon: epsilon, Users: numUsers}
+	if topologyFile != "" {
+		if topo.Ring, err = router.ReadTopologyFile(topologyFile, topo.ShardPool); err != nil {
+			log.Fatalf("topology: %v", err)
 		}
+		log.Printf("topology %s: epoch %d, shards %v", topologyFile, topo.Ring.Version(), topo.Ring.Shards())
 	}
-	if err := flush(); err != nil {
-		return err
-	}
-	return nil
-}
-
-// seedHash routes each insert to one of three shards using user_id % 3.
-// Each shard maintains its own pgx.Batch to minimize round-trips per shard.
-func seedHash(ctx context.Context, r *rand.Rand, numUsers, numPosts, batchSize, contentSize int) error {
-	pools, err := db.NewShardPools(ctx)
+	w, err := router.NewWriter(mode, topo)
 	if err != nil {
-		return err
-	}
-	for _, p := range pools {
-		defer p.Close()
+		log.Fatalf("router: %v", err)
 	}
 
-	log.Printf("seeding hash shards: users=%d posts=%d batch=%d", numUsers, numPosts, batchSize)
+	start := time.Now()
+	log.Printf("seeding %s: users=%d posts=%d batch=%d", mode, numUsers, numPosts, batchSize)
+	if err := seed(ctx, w, r, numUsers, numPosts, batchSize, contentSize); err != nil {
+		log.Fatalf("seed %s failed: %v", mode, err)
+	}
+	log.Printf("done in %s", time.Since(start).Truncate(time.Millisecond))
+}
 
-	// Same timestamp generation as baseline.
-	now := time.Now()
-	yearAgo := now.Add(-365 * 24 * time.Hour)
+// seed generates random posts and writes them through w in batches.
+// For sharded modes the router splits each batch into one pgx.Batch per shard.
+func seed(ctx context.Context, w router.PostWriter, r *rand.Rand, numUsers, numPosts, batchSize, contentSize int) error {
+	// Generate timestamps uniformly across the last year covered by the posts_range
+	// partitions, so mode=range has a partition for every row.
+	now := db.RangeUntil
+	yearAgo := now.AddDate(-1, 0, 0)
 
+	// Small helper to produce synthetic post content of fixed size.
 	makeContent := func() string {
 		var b strings.Builder
 		for i := 0; i < contentSize; i++ {
@@ -145,56 +105,26 @@ func seedHash(ctx context.Context, r *rand.Rand, numUsers, numPosts, batchSize,
 		return b.String()
 	}
 
-	// Per-shard batch accumulators.
-	type shardBatch struct {
-		batch   *pgx.Batch
-		pending int
-	}
-	sb := []shardBatch{
-		{batch: &pgx.Batch{}},
-		{batch: &pgx.Batch{}},
-		{batch: &pgx.Batch{}},
-	}
-
-	// flushShard sends pending INSERTs to a specific shard.
-	flushShard := func(idx int) error {
-		if sb[idx].pending == 0 {
-			return nil
-		}
-		br := pools[idx].SendBatch(ctx, sb[idx].batch)
-		for i := 0; i < sb[idx].pending; i++ {
-			if _, err := br.Exec(); err != nil {
-				_ = br.Close()
-				return fmt.Errorf("shard %d exec: %w", idx, err)
-			}
-		}
-		if err := br.Close(); err != nil {
-			return fmt.Errorf("shard %d close: %w", idx, err)
-		}
-		sb[idx] = shardBatch{batch: &pgx.Batch{}, pending: 0}
-		return nil
-	}
-
+	batch := make([]model.Post, 0, batchSize)
 	for i := 0; i < numPosts; i++ {
-		// Choose shard by hashing user_id.
+		// Random user among [1..numUsers]
 		userID := 1 + r.Int63n(int64(numUsers))
+		// Uniform sampling over the year for created_at
 		delta := r.Int63n(int64(now.Sub(yearAgo)))
-		createdAt := yearAgo.Add(time.Duration(delta))
-		content := makeContent()
-
-		shard := int(userID % 3)
-		sb[shard].batch.Queue(`INSERT INTO posts_hash (user_id, created_at, content) VALUES ($1,$2,$3)`, userID, createdAt, content)
-		sb[shard].pending++
-		if sb[shard].pending >= batchSize {
-			if err := flushShard(shard); err != nil {
+		batch = append(batch, model.Post{
+			UserID:    userID,
+			CreatedAt: yearAgo.Add(time.Duration(delta)),
+			Content:   makeContent(),
+		})
+		if len(batch) >= batchSize {
+			if _, err := w.InsertPosts(ctx, batch); err != nil {
 				return err
 			}
+			batch = batch[:0]
 		}
 	}
-	for i := 0; i < 3; i++ {
-		if err := flushShard(i); err != nil {
-			return err
-		}
+	if _, err := w.InsertPosts(ctx, batch); err != nil {
+		return err
 	}
 	return nil
 }
@@ -3,11 +3,16 @@ package db
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// RangeUntil is the upper bound of the monthly posts_range partitions
+// (sql/range_schema.sql, 2024-01 to 2025-12). A row dated after it has no partition.
+var RangeUntil = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
 // NewRangePool creates a connection pool to the same Postgres instance as baseline,
 // but the router will target the partitioned table (posts_range) for range benchmarks.
 func NewRangePool(ctx context.Context) (*pgxpool.Pool, error) {
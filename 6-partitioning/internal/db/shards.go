@@ -3,43 +3,129 @@ package db
 import (
 	"context"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// NewShardPools connects to three independent Postgres instances (shards).
-// The application routes rows to shards by user_id % 3.
-func NewShardPools(ctx context.Context) ([]*pgxpool.Pool, error) {
-	hosts := []string{
-		"postgres_shard_1",
-		"postgres_shard_2",
-		"postgres_shard_3",
+// defaultShardHosts are the shard primaries of docker-compose, in shard index order.
+var defaultShardHosts = []string{
+	"postgres_shard_1",
+	"postgres_shard_2",
+	"postgres_shard_3",
+}
+
+// ShardHosts returns the shard primaries in shard index order: SHARD_HOSTS, a
+// comma-separated host list, or the three compose shards. Hosts double as stable
+// shard IDs in topology files.
+func ShardHosts() []string {
+	var hosts []string
+	for _, h := range strings.Split(os.Getenv("SHARD_HOSTS"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
 	}
+	if len(hosts) == 0 {
+		return append([]string(nil), defaultShardHosts...)
+	}
+	return hosts
+}
+
+// NewShardPools connects to the independent Postgres instances (shards), three by
+// default. The application routes rows to shards by jump hash of the user ID.
+func NewShardPools(ctx context.Context) ([]*pgxpool.Pool, error) {
+	hosts := ShardHosts()
 	pools := make([]*pgxpool.Pool, 0, len(hosts))
 	for _, h := range hosts {
 		dsn := fmt.Sprintf("postgres://postgres:postgres@%s:5432/postgres?sslmode=disable", h)
-		cfg, err := pgxpool.ParseConfig(dsn)
+		pool, err := newShardPool(ctx, h, dsn)
 		if err != nil {
-			return nil, fmt.Errorf("parse shard %s dsn: %w", h, err)
-		}
-		cfg.MaxConns = 50
-		cfg.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeCacheStatement
-		cfg.ConnConfig.StatementCacheCapacity = 256
-		cfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
-			if _, err := conn.Exec(ctx, "SET enable_partitionwise_join = on"); err != nil {
-				return err
+			closeAll(pools)
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// NewShardReplicaPools connects to the read replicas of every shard, in shard index order.
+// Replicas are configured per shard with SHARD_<n>_REPLICAS (n = 1..N), a comma-separated
+// list of DSNs; a shard without the variable has no replicas and is read from its primary.
+func NewShardReplicaPools(ctx context.Context) ([][]*pgxpool.Pool, error) {
+	hosts := ShardHosts()
+	replicas := make([][]*pgxpool.Pool, len(hosts))
+	for i := range hosts {
+		env := fmt.Sprintf("SHARD_%d_REPLICAS", i+1)
+		for _, dsn := range strings.Split(os.Getenv(env), ",") {
+			dsn = strings.TrimSpace(dsn)
+			if dsn == "" {
+				continue
 			}
-			if _, err := conn.Exec(ctx, "SET enable_partitionwise_aggregate = on"); err != nil {
-				return err
+			pool, err := newShardPool(ctx, fmt.Sprintf("%s replica %d", hosts[i], len(replicas[i])+1), dsn)
+			if err != nil {
+				for _, ps := range replicas {
+					closeAll(ps)
+				}
+				return nil, err
 			}
-			return nil
+			replicas[i] = append(replicas[i], pool)
 		}
-		pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	}
+	return replicas, nil
+}
+
+// NewShardStandbyPools connects to the standby of every shard, in shard index order.
+// A standby is configured with SHARD_<n>_STANDBY (n = 1..N) holding its DSN; shards
+// without one get a nil entry.
+func NewShardStandbyPools(ctx context.Context) ([]*pgxpool.Pool, error) {
+	hosts := ShardHosts()
+	standbys := make([]*pgxpool.Pool, len(hosts))
+	for i, h := range hosts {
+		dsn := strings.TrimSpace(os.Getenv(fmt.Sprintf("SHARD_%d_STANDBY", i+1)))
+		if dsn == "" {
+			continue
+		}
+		pool, err := newShardPool(ctx, h+" standby", dsn)
 		if err != nil {
-			return nil, fmt.Errorf("connect shard %s: %w", h, err)
+			closeAll(standbys)
+			return nil, err
+		}
+		standbys[i] = pool
+	}
+	return standbys, nil
+}
+
+// newShardPool creates a pool with the settings shared by shard primaries and replicas.
+func newShardPool(ctx context.Context, name, dsn string) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parse shard %s dsn: %w", name, err)
+	}
+	cfg.MaxConns = 50
+	cfg.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeCacheStatement
+	cfg.ConnConfig.StatementCacheCapacity = 256
+	cfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		if _, err := conn.Exec(ctx, "SET enable_partitionwise_join = on"); err != nil {
+			return err
+		}
+		if _, err := conn.Exec(ctx, "SET enable_partitionwise_aggregate = on"); err != nil {
+			return err
+		}
+		return nil
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connect shard %s: %w", name, err)
+	}
+	return pool, nil
+}
+
+func closeAll(pools []*pgxpool.Pool) {
+	for _, p := range pools {
+		if p != nil {
+			p.Close()
 		}
-		pools = append(pools, pool)
 	}
-	return pools, nil
 }
@@ -4,7 +4,6 @@ package router
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"partitioning/ready/internal/model"
 
@@ -17,35 +16,46 @@ type BaselineRouter struct {
 }
 
 // GetFeed returns newest posts for the provided set of userIDs.
-// This is a straightforward query against the monolithic table.
+// The window comes from the context (see QueryFromContext); by default it is the
+// current month, to compare fairly with range pruning.
 func (r *BaselineRouter) GetFeed(ctx context.Context, userIDs []int64, limit int) ([]model.Post, error) {
+	return r.QueryFeed(ctx, userIDs, QueryFromContext(ctx, limit))
+}
+
+// QueryFeed runs q as a straightforward query against the monolithic table.
+func (r *BaselineRouter) QueryFeed(ctx context.Context, userIDs []int64, q FeedQuery) ([]model.Post, error) {
+	page, err := r.QueryFeedPage(ctx, userIDs, q)
+	return page.Posts, err
+}
+
+// QueryFeedPage returns one page of q; q.PageToken resumes after (created_at, id) of the previous page.
+func (r *BaselineRouter) QueryFeedPage(ctx context.Context, userIDs []int64, q FeedQuery) (FeedPage, error) {
 	if r.DB == nil {
-		return nil, fmt.Errorf("db is nil")
+		return FeedPage{}, fmt.Errorf("db is nil")
 	}
-	// Apply a month-aligned window to compare fairly with range pruning.
-	now := time.Now()
-	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
-	monthEnd := monthStart.AddDate(0, 1, 0)
-	const q = `
-	SELECT id, user_id, created_at, content
-	FROM posts
-	WHERE user_id = ANY($1) AND created_at >= $2 AND created_at < $3
-	ORDER BY created_at DESC
-	LIMIT $4;
-	`
-	rows, err := r.DB.Query(ctx, q, userIDs, monthStart, monthEnd, limit)
-	if err != nil {
-		return nil, fmt.Errorf("query baseline: %w", err)
+	if err := q.Validate(); err != nil {
+		return FeedPage{}, err
 	}
-	defer rows.Close()
-
-	var res []model.Post
-	for rows.Next() {
-		var p model.Post
-		if err := rows.Scan(&p.ID, &p.UserID, &p.CreatedAt, &p.Content); err != nil {
-			return nil, fmt.Errorf("scan: %w", err)
-		}
-		res = append(res, p)
+	return queryTablePage(ctx, r.DB, "posts", userIDs, q)
+}
+
+// InsertPost stores p in the posts table; the ID comes from its BIGSERIAL sequence.
+func (r *BaselineRouter) InsertPost(ctx context.Context, p model.Post) (model.Post, error) {
+	return firstPost(r.InsertPosts(ctx, []model.Post{p}))
+}
+
+// InsertPosts stores posts in a single batch round-trip.
+func (r *BaselineRouter) InsertPosts(ctx context.Context, posts []model.Post) ([]model.Post, error) {
+	if r.DB == nil {
+		return nil, fmt.Errorf("db is nil")
+	}
+	return insertPosts(ctx, r.DB, "posts", posts, false)
+}
+
+// DeletePost removes a post from the posts table.
+func (r *BaselineRouter) DeletePost(ctx context.Context, userID, postID int64) error {
+	if r.DB == nil {
+		return fmt.Errorf("db is nil")
 	}
-	return res, rows.Err()
+	return deletePost(ctx, r.DB, "posts", userID, postID)
 }
@@ -0,0 +1,250 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBoundedEpsilon is the load slack used by NewPartitioner for SchemeBounded.
+const DefaultBoundedEpsilon = 0.25
+
+// BoundedLoad implements consistent hashing with bounded loads (Mirrokni, Thorup,
+// Zadimoghaddam) on top of a Ring: every shard has a capacity of (1+ε) times its
+// share of the total load (its weight / total weight), and a key whose ring owner is
+// full walks clockwise to the next shard with room. This caps the overload a skewed
+// key set can cause, at the cost of moving some keys away from their ring owner.
+//
+// Owner never changes the loads: it is a pure function of the last snapshot, taken
+// either by AssignKeys (load = keys assigned) or SetLoads (e.g. queries in flight from
+// a ShardLoad). Reads therefore find the rows written under the same snapshot; taking
+// a new snapshot can move keys, like a topology change.
+//
+// Only AssignKeys placement may route stored data: every process that assigns the same
+// keys agrees on it. Live loads differ between processes and change from one snapshot
+// to the next, so a row written under one would be missed by a later read. They are for
+// stateless or cache traffic, where a miss costs a recomputation; ConsistentHashRouter
+// refuses to route by them (see LiveLoads).
+type BoundedLoad struct {
+	ring    *Ring
+	epsilon float64
+
+	mu       sync.RWMutex
+	loads    map[int]float64
+	capacity map[int]float64
+	assigned map[uint64]int // key -> shard from AssignKeys
+	live     bool           // the snapshot comes from SetLoads
+}
+
+// NewBoundedLoad wraps ring with bounded loads. epsilon must be positive: the smaller
+// it is, the flatter the load and the more keys leave their ring owner. Until the
+// first snapshot every shard has room, so keys go to their ring owner.
+func NewBoundedLoad(ring *Ring, epsilon float64) (*BoundedLoad, error) {
+	if ring == nil {
+		return nil, fmt.Errorf("bounded load needs a ring")
+	}
+	if epsilon <= 0 || math.IsNaN(epsilon) || math.IsInf(epsilon, 0) {
+		return nil, fmt.Errorf("epsilon must be positive, got %v", epsilon)
+	}
+	return &BoundedLoad{ring: ring, epsilon: epsilon}, nil
+}
+
+// BoundedOptions configures SchemeBounded in a Topology.
+type BoundedOptions struct {
+	// Epsilon is the load slack (default DefaultBoundedEpsilon).
+	Epsilon float64
+	// Users assigns users 1..Users up front (load = assigned users). Writers and
+	// readers must use the same value to agree on placement. It is required: modes
+	// hash-consistent and directory store posts where they place them, so they cannot
+	// follow live loads (see BoundedLoad).
+	Users int
+}
+
+// configure applies opts to b.
+func (b *BoundedLoad) configure(opts BoundedOptions) error {
+	if opts.Epsilon != 0 {
+		if opts.Epsilon < 0 || math.IsNaN(opts.Epsilon) || math.IsInf(opts.Epsilon, 0) {
+			return fmt.Errorf("epsilon must be positive, got %v", opts.Epsilon)
+		}
+		b.epsilon = opts.Epsilon
+	}
+	if opts.Users > 0 {
+		users := make([]int64, opts.Users)
+		for i := range users {
+			users[i] = int64(i + 1)
+		}
+		b.AssignUsers(users)
+	}
+	return nil
+}
+
+// Ring returns the underlying ring.
+func (b *BoundedLoad) Ring() *Ring {
+	return b.ring
+}
+
+// AssignUsers is AssignKeys for HashUser of every user ID.
+func (b *BoundedLoad) AssignUsers(userIDs []int64) {
+	keys := make([]uint64, len(userIDs))
+	for i, u := range userIDs {
+		keys[i] = HashUser(u)
+	}
+	b.AssignKeys(keys)
+}
+
+// AssignKeys places keys one by one, in ascending key order so the result does not
+// depend on the caller's order, and measures load as the number of keys per shard.
+// Shard s may take at most ceil((1+ε) · len(keys) · weight(s) / total weight) keys.
+// Owner returns the recorded shard for these keys; other keys go to the first shard
+// clockwise that is below its capacity.
+func (b *BoundedLoad) AssignKeys(keys []uint64) {
+	sorted := append([]uint64(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	capacity := b.capacities(float64(len(sorted)), math.Ceil)
+	loads := make(map[int]float64, len(capacity))
+	assigned := make(map[uint64]int, len(sorted))
+	for i, k := range sorted {
+		if i > 0 && k == sorted[i-1] {
+			continue
+		}
+		s := b.walk(k, loads, capacity)
+		assigned[k] = s
+		loads[s]++
+	}
+	b.mu.Lock()
+	b.loads, b.capacity, b.assigned, b.live = loads, capacity, assigned, false
+	b.mu.Unlock()
+}
+
+// SetLoads takes a snapshot of arbitrary per-shard loads, such as ShardLoad.Snapshot,
+// and drops the keys recorded by AssignKeys. A shard has room if one more unit of load
+// keeps it within (1+ε) · (total+1) · weight / total weight. The placement then follows
+// live traffic, so it is only fit for stateless or cache routing (see LiveLoads).
+func (b *BoundedLoad) SetLoads(loads map[int]float64) {
+	var total float64
+	snap := make(map[int]float64, len(loads))
+	for s, l := range loads {
+		snap[s] = l
+		total += l
+	}
+	capacity := b.capacities(total+1, func(x float64) float64 { return x })
+	b.mu.Lock()
+	b.loads, b.capacity, b.assigned, b.live = snap, capacity, nil, true
+	b.mu.Unlock()
+}
+
+// LiveLoads reports whether the current snapshot was taken by SetLoads. Owner then
+// depends on load at the time of the call, not on the key alone, and must not place
+// stored data.
+func (b *BoundedLoad) LiveLoads() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.live
+}
+
+// Loads returns the load and capacity of every shard in the current snapshot.
+func (b *BoundedLoad) Loads() (loads, capacity map[int]float64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	loads = make(map[int]float64, len(b.loads))
+	for s, l := range b.loads {
+		loads[s] = l
+	}
+	capacity = make(map[int]float64, len(b.capacity))
+	for s, c := range b.capacity {
+		capacity[s] = c
+	}
+	return loads, capacity
+}
+
+// Owner returns the shard of key under the current snapshot.
+func (b *BoundedLoad) Owner(key uint64) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if s, ok := b.assigned[key]; ok {
+		return s
+	}
+	if b.capacity == nil {
+		return b.ring.Owner(key)
+	}
+	return b.walk(key, b.loads, b.capacity)
+}
+
+// walk returns the first shard clockwise from key whose load is below its capacity,
+// or the ring owner if every shard is full.
+func (b *BoundedLoad) walk(key uint64, loads, capacity map[int]float64) int {
+	owner := b.ring.Owner(key)
+	b.ring.walk(key, func(s int) bool {
+		if loads[s]+1 <= capacity[s] {
+			owner = s
+			return false
+		}
+		return true
+	})
+	return owner
+}
+
+// capacities returns (1+ε) · total · weight / total weight for every ring shard,
+// rounded by round.
+func (b *BoundedLoad) capacities(total float64, round func(float64) float64) map[int]float64 {
+	var sum float64
+	for _, w := range b.ring.weights {
+		sum += w
+	}
+	capacity := make(map[int]float64, len(b.ring.weights))
+	for s, w := range b.ring.weights {
+		capacity[s] = round((1 + b.epsilon) * total * w / sum)
+	}
+	return capacity
+}
+
+// ShardLoad counts the queries in flight per shard. Set it in FanoutOptions.Load and
+// feed Snapshot to BoundedLoad.SetLoads to bound stateless traffic by live load. The
+// zero value is ready to use, and a nil *ShardLoad counts nothing.
+type ShardLoad struct {
+	mu     sync.Mutex
+	shards map[int]*atomic.Int64
+}
+
+func (l *ShardLoad) counter(shard int) *atomic.Int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shards == nil {
+		l.shards = make(map[int]*atomic.Int64)
+	}
+	c, ok := l.shards[shard]
+	if !ok {
+		c = new(atomic.Int64)
+		l.shards[shard] = c
+	}
+	return c
+}
+
+// begin and end count one query on shard.
+func (l *ShardLoad) begin(shard int) {
+	if l != nil {
+		l.counter(shard).Add(1)
+	}
+}
+
+func (l *ShardLoad) end(shard int) {
+	if l != nil {
+		l.counter(shard).Add(-1)
+	}
+}
+
+// Snapshot returns the number of queries in flight per shard.
+func (l *ShardLoad) Snapshot() map[int]float64 {
+	snap := make(map[int]float64)
+	if l == nil {
+		return snap
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for s, c := range l.shards {
+		snap[s] = float64(c.Load())
+	}
+	return snap
+}
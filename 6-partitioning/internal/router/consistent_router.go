@@ -2,102 +2,327 @@ package router
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sort"
-	"time"
+	"strconv"
 
 	"partitioning/ready/internal/model"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// ConsistentHashRouter routes by consistent hashing ring.
+// ConsistentHashRouter routes by consistent hashing (a vnode Ring or Rendezvous).
 // It minimizes key movement when shard membership changes.
 type ConsistentHashRouter struct {
 	Shards []*pgxpool.Pool
-	Ring   *Ring
+	// Partitioner maps HashUser(userID) to a shard index, e.g. *Ring or *Rendezvous.
+	Partitioner Partitioner
+	// Live, if set, replaces Shards and Partitioner: every request routes by the
+	// ShardRing current when it starts (owner slot -> ShardRing.Pools), so topology
+	// changes swap in atomically. Reads and Failover are indexed by shard index and
+	// are not used with Live.
+	Live *LiveRing
+	// Rebalance, if set, replaces Live: requests route by the RebalanceState current
+	// when they start, following an online move between two rings (see RebalancePhase).
+	Rebalance *RebalanceStore
 	// Table allows overriding the table name (default: posts_hash).
 	Table string
+	// IDs assigns post IDs on insert. It is required for writes, with a node ID no other
+	// writer uses (see NodeID).
+	IDs *IDGenerator
+	// ShardIDs names Shards, by index, in page tokens, Sessions and directory pins
+	// (default: the indexes, "0", "1", ...). Live and Rebalance use their rings' IDs.
+	ShardIDs []ShardID
+	// Reads routes shard reads to replicas (default nil: primaries only). Writes always
+	// go to the active shard pool.
+	Reads *ReadReplicas
+	// Failover, if set, replaces a failed shard's pool by its standby (see ShardMonitor).
+	Failover *ShardMonitor
+	// FanoutOptions tunes the fan-out: exact merge, partial results, timeouts, hedging.
+	FanoutOptions
+
+	lat shardLatencies // recent per-shard latencies for percentile hedging
 }
 
-func (r *ConsistentHashRouter) GetFeed(ctx context.Context, userIDs []int64, limit int) ([]model.Post, error) {
-	if r.Ring == nil || len(r.Shards) == 0 {
-		return nil, fmt.Errorf("router not initialized")
+// shardLayout is the placement one request routes by: a partitioner and the pools
+// its owners index.
+type shardLayout struct {
+	part  Partitioner
+	pools []*pgxpool.Pool
+	reads *ReadReplicas
+	// shadow is the other ring of a rebalance in progress, which also holds the users
+	// it owns as the phase says; nil otherwise.
+	shadow Partitioner
+	phase  RebalancePhase
+	// ids names the owners by index (see shardIDAt): page tokens, Sessions and
+	// directory pins refer to shards by ID, which survives topology changes.
+	ids []ShardID
+}
+
+// shardIDAt returns the ID of shard index s in ids, or the index itself for routers
+// whose shards have no IDs.
+func shardIDAt(ids []ShardID, s int) ShardID {
+	if s >= 0 && s < len(ids) {
+		return ids[s]
 	}
-	type shardResult struct {
-		posts []model.Post
-		err   error
+	return ShardID(strconv.Itoa(s))
+}
+
+// id returns the ID of owner s.
+func (l shardLayout) id(s int) ShardID {
+	return shardIDAt(l.ids, s)
+}
+
+// slotOf returns the owner index of shard id, if it is one of l's shards.
+func (l shardLayout) slotOf(id ShardID) (int, bool) {
+	for s := range l.pools {
+		if l.id(s) == id {
+			return s, true
+		}
 	}
-	perShard := make(map[int][]int64, len(r.Shards))
-	for _, id := range userIDs {
-		owner := r.Ring.Owner(HashUser(id))
-		perShard[owner] = append(perShard[owner], id)
+	return 0, false
+}
+
+// shardFor returns the owner of userID in l.
+func (l shardLayout) shardFor(userID int64) int {
+	return l.part.Owner(HashUser(userID))
+}
+
+// shadowFor returns the shadow owner of userID if it differs from owner. Users placed
+// elsewhere than their ring owner (directory pins) have none.
+func (l shardLayout) shadowFor(userID int64, owner int) (int, bool) {
+	if l.shadow == nil || owner != l.shardFor(userID) {
+		return 0, false
+	}
+	s := l.shadow.Owner(HashUser(userID))
+	return s, s != owner
+}
+
+// layout returns the current placement: the Rebalance state or the Live ring if set,
+// else Partitioner over the active Shards.
+func (r *ConsistentHashRouter) layout() (shardLayout, error) {
+	if r.Rebalance != nil {
+		st := r.Rebalance.Load()
+		if st == nil {
+			return shardLayout{}, fmt.Errorf("router not initialized")
+		}
+		return st.layout()
 	}
-	table := r.Table
-	if table == "" {
-		table = "posts_hash"
-	}
-	cutoff := time.Now().Add(-7 * 24 * time.Hour)
-	q := fmt.Sprintf(`
-	SELECT id, user_id, created_at, content
-	FROM %s
-WHERE user_id = ANY($1) AND created_at >= $2
-	ORDER BY created_at DESC
-LIMIT $3;`, table)
-	results := make(chan shardResult, len(r.Shards))
-
-	// Distribute global LIMIT across active shards.
-	active := 0
-	for _, ids := range perShard {
-		if len(ids) > 0 {
-			active++
+	if r.Live != nil {
+		ring := r.Live.Load()
+		if ring == nil || len(ring.Shards()) == 0 {
+			return shardLayout{}, fmt.Errorf("router not initialized")
 		}
+		if id := ring.missingPool(); id != "" {
+			return shardLayout{}, fmt.Errorf("shard %s has no pool", id)
+		}
+		return shardLayout{part: ring, pools: ring.Pools(), ids: ring.ids}, nil
+	}
+	if r.Partitioner == nil || len(r.Shards) == 0 {
+		return shardLayout{}, fmt.Errorf("router not initialized")
 	}
-	perLimit := limit
-	if active > 1 {
-		perLimit = (limit + active - 1) / active
+	if b, ok := r.Partitioner.(*BoundedLoad); ok && b.LiveLoads() {
+		return shardLayout{}, fmt.Errorf("bounded load placement follows live loads, which cannot route stored posts (use AssignKeys)")
 	}
+	if r.ShardIDs != nil && len(r.ShardIDs) != len(r.Shards) {
+		return shardLayout{}, fmt.Errorf("got %d shard IDs for %d shards", len(r.ShardIDs), len(r.Shards))
+	}
+	return shardLayout{part: r.Partitioner, pools: r.Failover.activePools(r.Shards), reads: r.Reads, ids: r.ShardIDs}, nil
+}
+
+// ShardFor returns the index of the shard owning userID according to the partitioner
+// (the slot on the Live ring, if set).
+func (r *ConsistentHashRouter) ShardFor(userID int64) int {
+	l, err := r.layout()
+	if err != nil {
+		return 0
+	}
+	return l.shardFor(userID)
+}
+
+// ShardOf implements ShardLocator with the partitioner.
+func (r *ConsistentHashRouter) ShardOf(_ context.Context, userID int64) (int, error) {
+	l, err := r.layout()
+	if err != nil {
+		return 0, err
+	}
+	return l.shardFor(userID), nil
+}
+
+// locateFunc resolves the owners of a batch of users in layout l and returns the
+// resulting user -> shard mapping. It lets DirectoryRouter reuse the ring router's
+// read and write paths with its own placement.
+type locateFunc func(ctx context.Context, l shardLayout, userIDs []int64) (func(int64) int, error)
+
+// locateRing places every user by the partitioner.
+func (r *ConsistentHashRouter) locateRing(_ context.Context, l shardLayout, _ []int64) (func(int64) int, error) {
+	return l.shardFor, nil
+}
+
+func (r *ConsistentHashRouter) table() string {
+	if r.Table == "" {
+		return "posts_hash"
+	}
+	return r.Table
+}
+
+// GetFeed runs the feed query with the window carried by ctx (see QueryFromContext).
+func (r *ConsistentHashRouter) GetFeed(ctx context.Context, userIDs []int64, limit int) ([]model.Post, error) {
+	return r.QueryFeed(ctx, userIDs, QueryFromContext(ctx, limit))
+}
+
+// QueryFeed groups userIDs by ring owner, queries the owners in parallel and
+// returns the global top-N by created_at DESC.
+// With AllowPartial, a failing shard yields the other shards' posts and a *PartialResultError.
+func (r *ConsistentHashRouter) QueryFeed(ctx context.Context, userIDs []int64, fq FeedQuery) ([]model.Post, error) {
+	res, _, err := r.query(ctx, r.locateRing, userIDs, fq)
+	if err != nil {
+		return nil, err
+	}
+	return res.posts(), res.partialErr()
+}
 
-	for idx, ids := range perShard {
-		if len(ids) == 0 {
-			results <- shardResult{}
+// QueryFeedStats is QueryFeed that also reports how many rows the fan-out read.
+func (r *ConsistentHashRouter) QueryFeedStats(ctx context.Context, userIDs []int64, fq FeedQuery) ([]model.Post, FanoutStats, error) {
+	res, _, err := r.query(ctx, r.locateRing, userIDs, fq)
+	if err != nil {
+		return nil, res.stats, err
+	}
+	return res.posts(), res.stats, res.partialErr()
+}
+
+// QueryFeedPage returns one page of fq. The next token stores the position of the
+// last post returned from every shard, so each shard resumes exactly where it stopped.
+func (r *ConsistentHashRouter) QueryFeedPage(ctx context.Context, userIDs []int64, fq FeedQuery) (FeedPage, error) {
+	res, cur, err := r.query(ctx, r.locateRing, userIDs, fq)
+	if err != nil {
+		return FeedPage{}, err
+	}
+	return res.page(cur), res.partialErr()
+}
+
+func (r *ConsistentHashRouter) query(ctx context.Context, locate locateFunc, userIDs []int64, fq FeedQuery) (fanoutResult, *pageCursor, error) {
+	targets, cur, err := r.targets(ctx, locate, userIDs, fq)
+	if err != nil {
+		return fanoutResult{}, nil, err
+	}
+	res, err := fanOut(ctx, r.table(), targets, fq, r.FanoutOptions, &r.lat)
+	return res, cur, err
+}
+
+// IterFeed streams fq from the ring owners through a heap merge (see FeedIterator).
+func (r *ConsistentHashRouter) IterFeed(ctx context.Context, userIDs []int64, fq FeedQuery) (*FeedIterator, error) {
+	return r.iter(ctx, r.locateRing, userIDs, fq)
+}
+
+func (r *ConsistentHashRouter) iter(ctx context.Context, locate locateFunc, userIDs []int64, fq FeedQuery) (*FeedIterator, error) {
+	targets, cur, err := r.targets(ctx, locate, userIDs, fq)
+	if err != nil {
+		return nil, err
+	}
+	return openIterator(ctx, r.table(), targets, fq, cur, r.FanoutOptions)
+}
+
+// targets validates fq and groups userIDs by owner, starting each shard at its
+// position from fq.PageToken.
+func (r *ConsistentHashRouter) targets(ctx context.Context, locate locateFunc, userIDs []int64, fq FeedQuery) ([]*shardFetch, *pageCursor, error) {
+	if err := fq.Validate(); err != nil {
+		return nil, nil, err
+	}
+	l, err := r.layout()
+	if err != nil {
+		return nil, nil, err
+	}
+	cur, err := decodeCursor(fq.PageToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	shardFor, err := locate(ctx, l, userIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	perShard := make(map[int][]int64, len(l.pools))
+	for _, id := range userIDs {
+		owner := shardFor(id)
+		perShard[owner] = append(perShard[owner], id)
+		if !l.phase.readsShadow() {
 			continue
 		}
-		pool := r.Shards[idx]
-		go func(ids []int64, pool *pgxpool.Pool) {
-			rows, err := pool.Query(ctx, q, ids, cutoff, perLimit)
-			if err != nil {
-				results <- shardResult{err: err}
-				return
-			}
-			defer rows.Close()
-			var ps []model.Post
-			for rows.Next() {
-				var p model.Post
-				if err := rows.Scan(&p.ID, &p.UserID, &p.CreatedAt, &p.Content); err != nil {
-					results <- shardResult{err: err}
-					return
-				}
-				ps = append(ps, p)
-			}
-			if err := rows.Err(); err != nil {
-				results <- shardResult{err: err}
-				return
-			}
-			results <- shardResult{posts: ps}
-		}(ids, pool)
-	}
-	var merged []model.Post
-	for i := 0; i < len(perShard); i++ {
-		r := <-results
-		if r.err != nil {
-			return nil, r.err
+		if s, ok := l.shadowFor(id, owner); ok {
+			perShard[s] = append(perShard[s], id)
 		}
-		merged = append(merged, r.posts...)
 	}
-	sort.Slice(merged, func(i, j int) bool { return merged[i].CreatedAt.After(merged[j].CreatedAt) })
-	if len(merged) > limit {
-		merged = merged[:limit]
+	return shardTargets(ctx, perShard, l.pools, l.ids, l.reads, cur), cur, nil
+}
+
+// InsertPost stores p on the ring owner of p.UserID and returns it with its ID.
+func (r *ConsistentHashRouter) InsertPost(ctx context.Context, p model.Post) (model.Post, error) {
+	return firstPost(r.InsertPosts(ctx, []model.Post{p}))
+}
+
+// InsertPosts groups posts by ring owner and writes one batch per shard.
+func (r *ConsistentHashRouter) InsertPosts(ctx context.Context, posts []model.Post) ([]model.Post, error) {
+	return r.insert(ctx, r.locateRing, posts)
+}
+
+func (r *ConsistentHashRouter) insert(ctx context.Context, locate locateFunc, posts []model.Post) ([]model.Post, error) {
+	l, err := r.layout()
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]int64, len(posts))
+	for i, p := range posts {
+		userIDs[i] = p.UserID
+	}
+	shardFor, err := locate(ctx, l, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	out, err := insertSharded(ctx, l.pools, l.ids, r.table(), r.IDs, shardFor, posts)
+	if err != nil || !l.phase.writesShadow() {
+		return out, err
+	}
+	if err := mirrorPosts(ctx, l, r.table(), shardFor, out); err != nil {
+		// The posts are on their owners: report them as stored, so nobody retries
+		// them under new IDs.
+		stored := make([]bool, len(out))
+		for i := range stored {
+			stored[i] = true
+		}
+		return out, &PartialWriteError{Posts: out, Stored: stored, Err: err}
+	}
+	return out, nil
+}
+
+// DeletePost removes a post from the ring owner of userID.
+func (r *ConsistentHashRouter) DeletePost(ctx context.Context, userID, postID int64) error {
+	return r.delete(ctx, r.locateRing, userID, postID)
+}
+
+func (r *ConsistentHashRouter) delete(ctx context.Context, locate locateFunc, userID, postID int64) error {
+	l, err := r.layout()
+	if err != nil {
+		return err
+	}
+	shardFor, err := locate(ctx, l, []int64{userID})
+	if err != nil {
+		return err
+	}
+	s := shardFor(userID)
+	err = deletePost(ctx, l.pools[s], r.table(), userID, postID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	sessionFrom(ctx).wrote(l.id(s))
+	if shadow, ok := l.shadowFor(userID, s); ok && l.phase.deletesShadow() {
+		// The post is gone once neither owner has it.
+		switch serr := deletePost(ctx, l.pools[shadow], r.table(), userID, postID); {
+		case serr == nil:
+			err = nil
+		case !errors.Is(serr, ErrNotFound):
+			return serr
+		}
+		sessionFrom(ctx).wrote(l.id(shadow))
 	}
-	return merged, nil
+	return err
 }
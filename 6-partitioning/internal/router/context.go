@@ -10,6 +10,7 @@ type ctxKey string
 // CtxCutoffKey carries a time.Time cutoff for created_at filtering.
 const CtxCutoffKey ctxKey = "cutoffTime"
 
+// GetCutoff returns the cutoff stored under CtxCutoffKey, if any.
 func GetCutoff(ctx context.Context) (time.Time, bool) {
 	v := ctx.Value(CtxCutoffKey)
 	if v == nil {
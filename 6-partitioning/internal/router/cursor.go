@@ -0,0 +1,77 @@
+package router
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"partitioning/ready/internal/model"
+)
+
+// ErrInvalidPageToken is returned when a page token cannot be decoded.
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// FeedPage is one page of a feed plus the token for the next one.
+type FeedPage struct {
+	Posts []model.Post
+	// NextPageToken resumes right after the last post of this page.
+	// It is empty when there are no more posts.
+	NextPageToken string
+	// Shards reports each shard's part in a fan-out read (nil for single-table routers).
+	Shards []ShardStatus
+}
+
+// pageCursor is the decoded form of a page token.
+// Last is the position of the last post returned; single-table routers resume after it.
+// Shards holds, per shard ID, the position of the last post returned from that shard,
+// so fan-out routers resume every shard exactly where it stopped even if the
+// previous page did not read it up to Last. Keys are shard IDs, not indexes, so a
+// token stays valid when the topology changes between pages. Shards without an entry resume after Last;
+// a zero entry (a shard that failed in partial mode) restarts from the top.
+type pageCursor struct {
+	Last   postKey            `json:"last"`
+	Shards map[string]postKey `json:"shards,omitempty"`
+}
+
+// encode renders the cursor as an opaque URL-safe token.
+func (c pageCursor) encode() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		// Only plain values are marshaled; this cannot happen.
+		panic(fmt.Sprintf("encode page token: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses a page token; an empty token means the first page (nil cursor).
+func decodeCursor(token string) (*pageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+	}
+	var c pageCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+	}
+	return &c, nil
+}
+
+// shardPos returns where shard id should resume: its own position if known,
+// otherwise the global one.
+func (c *pageCursor) shardPos(id ShardID) *postKey {
+	if c == nil {
+		return nil
+	}
+	if k, ok := c.Shards[string(id)]; ok {
+		if k.CreatedAt.IsZero() && k.ID == 0 {
+			return nil
+		}
+		return &k
+	}
+	k := c.Last
+	return &k
+}
@@ -0,0 +1,73 @@
+package router
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestPageCursorRoundTrip(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+	tests := []struct {
+		name   string
+		cursor pageCursor
+	}{
+		{"last only", pageCursor{Last: postKey{CreatedAt: at, ID: 42}}},
+		{"per shard", pageCursor{Last: postKey{CreatedAt: at, ID: 42}, Shards: map[string]postKey{
+			"postgres_shard_1": {CreatedAt: at, ID: 42},
+			"postgres_shard_3": {CreatedAt: at.Add(-time.Hour), ID: 7},
+		}}},
+		{"failed shard restarts", pageCursor{Last: postKey{CreatedAt: at, ID: 42}, Shards: map[string]postKey{"postgres_shard_2": {}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCursor(tt.cursor.encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.cursor) {
+				t.Errorf("decoded %+v, want %+v", *got, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	if c, err := decodeCursor(""); c != nil || err != nil {
+		t.Errorf("empty token: %v, %v; want the first page", c, err)
+	}
+	for _, token := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err := decodeCursor(token); !errors.Is(err, ErrInvalidPageToken) {
+			t.Errorf("token %q: error %v, want ErrInvalidPageToken", token, err)
+		}
+	}
+}
+
+func TestShardPosByID(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC)
+	c := &pageCursor{Last: postKey{CreatedAt: at, ID: 42}, Shards: map[string]postKey{
+		"postgres_shard_3": {CreatedAt: at.Add(-time.Hour), ID: 7},
+		"postgres_shard_2": {},
+	}}
+	// After postgres_shard_2 leaves the ring, postgres_shard_3 takes its slot; the
+	// position stays with the shard, not the slot.
+	l := shardLayout{pools: make([]*pgxpool.Pool, 2), ids: []ShardID{"postgres_shard_1", "postgres_shard_3"}}
+	if got := c.shardPos(l.id(1)); got == nil || got.ID != 7 {
+		t.Errorf("postgres_shard_3 resumes at %+v, want id 7", got)
+	}
+	if got := c.shardPos(l.id(0)); got == nil || got.ID != 42 {
+		t.Errorf("postgres_shard_1 resumes at %+v, want the last post", got)
+	}
+	if got := c.shardPos("postgres_shard_2"); got != nil {
+		t.Errorf("failed postgres_shard_2 resumes at %+v, want from the top", got)
+	}
+	if s, ok := l.slotOf("postgres_shard_3"); !ok || s != 1 {
+		t.Errorf("slotOf(postgres_shard_3) = %d, %v; want 1", s, ok)
+	}
+	if _, ok := l.slotOf("postgres_shard_2"); ok {
+		t.Error("slotOf found a shard that left the ring")
+	}
+}
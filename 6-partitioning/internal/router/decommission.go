@@ -0,0 +1,122 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Decommission takes shard id off the ring of the Rebalancer's store: its hash ranges
+// go to the shards that follow its points (ShardRing.Remove), and no other user moves.
+// The data is drained online like any rebalance (Run), at most RowsPerSecond rows per
+// second, and every batch is verified on its new owner before it is deleted from id;
+// Run does not leave cleanup before the drained ranges are empty on id.
+//
+// Rows of id outside its ranges (misplaced, see migrate -repair) would not be moved,
+// so Decommission refuses to start while there are any. Once the state is stable on
+// the new ring, it closes the shard's pool if the shard holds no rows of table, and
+// if the pool is not shared: the pool of the store (which also holds the directory
+// and migration jobs), the pools in Keep and those of the other shards stay open.
+// If a rebalance removing id is already in progress, Decommission resumes it.
+// It returns the new ring.
+func (rb *Rebalancer) Decommission(ctx context.Context, id ShardID) (*ShardRing, error) {
+	st, err := rb.Store.Refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := st.From.Slot(id); !ok {
+		return nil, fmt.Errorf("decommission %s: not on the ring", id)
+	}
+	to := st.To
+	if st.Phase == PhaseStable {
+		if to, err = st.From.Remove(id); err != nil {
+			return nil, err
+		}
+		if len(to.Shards()) == 0 {
+			return nil, fmt.Errorf("decommission %s: it is the last shard", id)
+		}
+	} else if _, ok := to.Slot(id); ok {
+		return nil, fmt.Errorf("decommission %s: a rebalance to epoch %d that keeps it is in progress", id, to.Version())
+	}
+	pool := st.From.Pool(id)
+	// Another shard's rows share the table of a shared pool, so only a pool of its own
+	// can be counted as a whole.
+	shared := rb.sharedPool(pool, id, st.From, to)
+	if st.Phase == PhaseStable && !rb.otherShardPool(pool, id, st.From, to) {
+		n, err := misplacedRows(ctx, st.From, id, rb.table())
+		if err != nil {
+			return nil, fmt.Errorf("decommission %s: %w", id, err)
+		}
+		if n > 0 {
+			return nil, fmt.Errorf("decommission %s: %d rows outside its ranges (see migrate -repair), nothing moved", id, n)
+		}
+	}
+	if err := rb.Run(ctx, to); err != nil {
+		return nil, fmt.Errorf("decommission %s: %w", id, err)
+	}
+	if shared {
+		return to, nil
+	}
+	var left int64
+	if err := pool.QueryRow(ctx, fmt.Sprintf(`SELECT count(*) FROM %s`, rb.table())).Scan(&left); err != nil {
+		return to, fmt.Errorf("decommission %s: count %s: %w", id, rb.table(), err)
+	}
+	if left > 0 {
+		return to, fmt.Errorf("decommission %s: %d rows left, pool kept open", id, left)
+	}
+	pool.Close()
+	return to, nil
+}
+
+// sharedPool reports whether pool, the pool of shard id, must stay open after id
+// leaves: it is the store's pool, one of Keep, or the pool of another shard.
+func (rb *Rebalancer) sharedPool(pool *pgxpool.Pool, id ShardID, rings ...*ShardRing) bool {
+	if pool == rb.Store.pool {
+		return true
+	}
+	for _, p := range rb.Keep {
+		if p == pool {
+			return true
+		}
+	}
+	return rb.otherShardPool(pool, id, rings...)
+}
+
+// otherShardPool reports whether a shard other than id is on pool in one of rings.
+func (rb *Rebalancer) otherShardPool(pool *pgxpool.Pool, id ShardID, rings ...*ShardRing) bool {
+	for _, r := range rings {
+		for _, other := range r.Shards() {
+			if other != id && r.Pool(other) == pool {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// misplacedRows counts the rows of table on shard id whose user_hash is not in one of
+// id's ranges on ring, including rows without a user_hash.
+func misplacedRows(ctx context.Context, ring *ShardRing, id ShardID, table string) (int64, error) {
+	slot, _ := ring.Slot(id)
+	var in []string
+	var args []any
+	for _, r := range ring.Ranges() {
+		if r.Shard != slot {
+			continue
+		}
+		where, a := rangeWhere(r.HashRange, len(args)+1)
+		in = append(in, "("+where+")")
+		args = append(args, a...)
+	}
+	sql := fmt.Sprintf(`SELECT count(*) FROM %s`, table)
+	if len(in) > 0 {
+		sql += fmt.Sprintf(` WHERE user_hash IS NULL OR NOT (%s)`, strings.Join(in, " OR "))
+	}
+	var n int64
+	if err := ring.Pool(id).QueryRow(ctx, sql, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("count %s: %w", table, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,203 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DirectoryOptions tunes a Directory.
+type DirectoryOptions struct {
+	// Table is the mapping table (default: shard_directory, see sql/directory_schema.sql).
+	Table string
+	// TTL bounds how long a cached lookup, including "no entry", is trusted (default: 30s).
+	// It caps staleness when another process changes the directory and Listen is not running.
+	TTL time.Duration
+	// MaxEntries caps the cache size; the cache is cleared when it is reached (default: 100000).
+	MaxEntries int
+}
+
+// Directory maps users to shards explicitly: a user with an entry lives on that shard
+// whatever the ring says. Entries name the shard by ShardID, so they keep pointing at
+// the same shard when the ring changes. Lookups are cached. Pin and Unpin invalidate the local cache
+// and notify other processes, which drop the entry if they run Listen.
+//
+// Changing an entry does not move the user's posts; move them first (or right after,
+// with reads tolerating the gap).
+type Directory struct {
+	pool *pgxpool.Pool
+	opts DirectoryOptions
+
+	mu    sync.RWMutex
+	cache map[int64]directoryEntry
+	// gen counts invalidations. Lookup does not cache what it read if gen changed
+	// while its query ran: the answer may predate a Pin or Unpin.
+	gen uint64
+}
+
+type directoryEntry struct {
+	shard   ShardID
+	pinned  bool // false: the user has no entry and follows the ring
+	expires time.Time
+}
+
+// directoryChannel is the NOTIFY channel carrying user IDs whose entry changed.
+const directoryChannel = "shard_directory"
+
+// NewDirectory returns a directory stored in a table on pool.
+func NewDirectory(pool *pgxpool.Pool, opts DirectoryOptions) *Directory {
+	if opts.Table == "" {
+		opts.Table = "shard_directory"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 30 * time.Second
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 100000
+	}
+	return &Directory{pool: pool, opts: opts, cache: make(map[int64]directoryEntry)}
+}
+
+// Lookup returns the pinned shard of every user in userIDs that has an entry.
+// Cached answers are used when fresh; the rest is read in one query, and cached
+// unless the directory was invalidated while the query ran.
+func (d *Directory) Lookup(ctx context.Context, userIDs []int64) (map[int64]ShardID, error) {
+	pinned := make(map[int64]ShardID)
+	var missing []int64
+	now := time.Now()
+	d.mu.RLock()
+	gen := d.gen
+	for _, id := range userIDs {
+		e, ok := d.cache[id]
+		switch {
+		case !ok || now.After(e.expires):
+			missing = append(missing, id)
+		case e.pinned:
+			pinned[id] = e.shard
+		}
+	}
+	d.mu.RUnlock()
+	if len(missing) == 0 {
+		return pinned, nil
+	}
+
+	rows, err := d.pool.Query(ctx, fmt.Sprintf(`SELECT user_id, shard FROM %s WHERE user_id = ANY($1)`, d.opts.Table), missing)
+	if err != nil {
+		return nil, fmt.Errorf("directory lookup: %w", err)
+	}
+	defer rows.Close()
+	found := make(map[int64]ShardID)
+	for rows.Next() {
+		var id int64
+		var shard ShardID
+		if err := rows.Scan(&id, &shard); err != nil {
+			return nil, fmt.Errorf("directory scan: %w", err)
+		}
+		found[id] = shard
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("directory lookup: %w", err)
+	}
+
+	expires := time.Now().Add(d.opts.TTL)
+	d.mu.Lock()
+	stale := d.gen != gen
+	if !stale && len(d.cache)+len(missing) > d.opts.MaxEntries {
+		d.cache = make(map[int64]directoryEntry)
+	}
+	for _, id := range missing {
+		shard, ok := found[id]
+		if !stale {
+			d.cache[id] = directoryEntry{shard: shard, pinned: ok, expires: expires}
+		}
+		if ok {
+			pinned[id] = shard
+		}
+	}
+	d.mu.Unlock()
+	return pinned, nil
+}
+
+// Pin places userID on shard, replacing any previous entry.
+func (d *Directory) Pin(ctx context.Context, userID int64, shard ShardID) error {
+	sql := fmt.Sprintf(`
+	WITH up AS (
+		INSERT INTO %s (user_id, shard, updated_at) VALUES ($1, $2, now())
+		ON CONFLICT (user_id) DO UPDATE SET shard = EXCLUDED.shard, updated_at = EXCLUDED.updated_at
+		RETURNING user_id
+	)
+	SELECT pg_notify($3, user_id::text) FROM up;`, d.opts.Table)
+	if _, err := d.pool.Exec(ctx, sql, userID, string(shard), directoryChannel); err != nil {
+		return fmt.Errorf("directory pin user %d: %w", userID, err)
+	}
+	d.Invalidate(userID)
+	return nil
+}
+
+// Unpin removes the entry of userID, so it follows the ring again.
+func (d *Directory) Unpin(ctx context.Context, userID int64) error {
+	sql := fmt.Sprintf(`
+	WITH del AS (
+		DELETE FROM %s WHERE user_id = $1 RETURNING user_id
+	)
+	SELECT pg_notify($2, user_id::text) FROM del;`, d.opts.Table)
+	if _, err := d.pool.Exec(ctx, sql, userID, directoryChannel); err != nil {
+		return fmt.Errorf("directory unpin user %d: %w", userID, err)
+	}
+	d.Invalidate(userID)
+	return nil
+}
+
+// Invalidate drops the cached entries of userIDs.
+func (d *Directory) Invalidate(userIDs ...int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	for _, id := range userIDs {
+		delete(d.cache, id)
+	}
+}
+
+// InvalidateAll drops the whole cache.
+func (d *Directory) InvalidateAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	d.cache = make(map[int64]directoryEntry)
+}
+
+// Listen invalidates cached entries changed by other processes until ctx is done.
+// It holds one connection of the pool for LISTEN. Notifications sent while it is not
+// connected are lost, so it clears the whole cache each time it (re)starts listening.
+func (d *Directory) Listen(ctx context.Context) error {
+	conn, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("directory listen: %w", err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "LISTEN "+directoryChannel); err != nil {
+		return fmt.Errorf("directory listen: %w", err)
+	}
+	d.InvalidateAll()
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// The connection state is unknown; do not hand it back to the pool.
+			conn.Conn().Close(context.Background())
+			return fmt.Errorf("directory listen: %w", err)
+		}
+		id, err := strconv.ParseInt(n.Payload, 10, 64)
+		if err != nil {
+			d.InvalidateAll()
+			continue
+		}
+		d.Invalidate(id)
+	}
+}
@@ -0,0 +1,120 @@
+package router
+
+import (
+	"context"
+	"fmt"
+
+	"partitioning/ready/internal/model"
+)
+
+// ShardLocator reports which shard owns a user. Migration tooling uses it to compare
+// placements, so explicit pins are honoured the same way reads and writes honour them.
+type ShardLocator interface {
+	ShardOf(ctx context.Context, userID int64) (int, error)
+}
+
+var (
+	_ ShardLocator = (*HashRouter)(nil)
+	_ ShardLocator = (*ConsistentHashRouter)(nil)
+	_ ShardLocator = (*DirectoryRouter)(nil)
+)
+
+// DirectoryRouter places users by an explicit Directory first and falls back to the
+// consistent hashing ring for users without an entry. It lets a celebrity or a big
+// tenant be pinned to a dedicated shard while everyone else stays on the ring.
+// Reads, writes, partial results, replicas and failover work as in ConsistentHashRouter.
+type DirectoryRouter struct {
+	*ConsistentHashRouter
+	Directory *Directory
+}
+
+// locate looks up the pinned users of the batch and returns their placement in l.
+func (r *DirectoryRouter) locate(ctx context.Context, l shardLayout, userIDs []int64) (func(int64) int, error) {
+	if r.Directory == nil {
+		return l.shardFor, nil
+	}
+	pins, err := r.Directory.Lookup(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	pinned := make(map[int64]int, len(pins))
+	for id, shard := range pins {
+		s, ok := l.slotOf(shard)
+		if !ok || l.pools[s] == nil {
+			return nil, fmt.Errorf("user %d pinned to shard %s, which is not serving", id, shard)
+		}
+		pinned[id] = s
+	}
+	return func(id int64) int {
+		if s, ok := pinned[id]; ok {
+			return s
+		}
+		return l.shardFor(id)
+	}, nil
+}
+
+// ShardOf returns the pinned shard of userID, or its ring owner.
+func (r *DirectoryRouter) ShardOf(ctx context.Context, userID int64) (int, error) {
+	l, err := r.layout()
+	if err != nil {
+		return 0, err
+	}
+	shardFor, err := r.locate(ctx, l, []int64{userID})
+	if err != nil {
+		return 0, err
+	}
+	return shardFor(userID), nil
+}
+
+// GetFeed runs the feed query with the window carried by ctx (see QueryFromContext).
+func (r *DirectoryRouter) GetFeed(ctx context.Context, userIDs []int64, limit int) ([]model.Post, error) {
+	return r.QueryFeed(ctx, userIDs, QueryFromContext(ctx, limit))
+}
+
+// QueryFeed groups userIDs by owner, queries the owners in parallel and
+// returns the global top-N by created_at DESC.
+func (r *DirectoryRouter) QueryFeed(ctx context.Context, userIDs []int64, fq FeedQuery) ([]model.Post, error) {
+	res, _, err := r.query(ctx, r.locate, userIDs, fq)
+	if err != nil {
+		return nil, err
+	}
+	return res.posts(), res.partialErr()
+}
+
+// QueryFeedStats is QueryFeed that also reports how many rows the fan-out read.
+func (r *DirectoryRouter) QueryFeedStats(ctx context.Context, userIDs []int64, fq FeedQuery) ([]model.Post, FanoutStats, error) {
+	res, _, err := r.query(ctx, r.locate, userIDs, fq)
+	if err != nil {
+		return nil, res.stats, err
+	}
+	return res.posts(), res.stats, res.partialErr()
+}
+
+// QueryFeedPage returns one page of fq (see ConsistentHashRouter.QueryFeedPage).
+func (r *DirectoryRouter) QueryFeedPage(ctx context.Context, userIDs []int64, fq FeedQuery) (FeedPage, error) {
+	res, cur, err := r.query(ctx, r.locate, userIDs, fq)
+	if err != nil {
+		return FeedPage{}, err
+	}
+	return res.page(cur), res.partialErr()
+}
+
+// IterFeed streams fq from the owners through a heap merge (see FeedIterator).
+func (r *DirectoryRouter) IterFeed(ctx context.Context, userIDs []int64, fq FeedQuery) (*FeedIterator, error) {
+	return r.iter(ctx, r.locate, userIDs, fq)
+}
+
+// InsertPost stores p on the owner of p.UserID and returns it with its ID.
+func (r *DirectoryRouter) InsertPost(ctx context.Context, p model.Post) (model.Post, error) {
+	return firstPost(r.InsertPosts(ctx, []model.Post{p}))
+}
+
+// InsertPosts groups posts by owner and writes one batch per shard.
+func (r *DirectoryRouter) InsertPosts(ctx context.Context, posts []model.Post) ([]model.Post, error) {
+	return r.insert(ctx, r.locate, posts)
+}
+
+// DeletePost removes a post from the owner of userID.
+func (r *DirectoryRouter) DeletePost(ctx context.Context, userID, postID int64) error {
+	return r.delete(ctx, r.locate, userID, postID)
+}
@@ -0,0 +1,247 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FailoverOptions tunes a ShardMonitor.
+type FailoverOptions struct {
+	// Interval between health probes of each shard (default: 1s).
+	Interval time.Duration
+	// ProbeTimeout bounds one probe (default: 500ms).
+	ProbeTimeout time.Duration
+	// FailAfter is the number of consecutive failed probes of the primary before the
+	// shard switches to its standby (default: 3).
+	FailAfter int
+	// RecoverAfter is the number of consecutive successful probes of a down primary
+	// before it is reported up (default: 3). A shard on its standby stays there until
+	// Failback is called.
+	RecoverAfter int
+	// OnEvent, if set, is called for every event, from the monitor's goroutine.
+	OnEvent func(FailoverEvent)
+}
+
+// FailoverEventType classifies a FailoverEvent.
+type FailoverEventType string
+
+const (
+	// EventFailover: the primary is down and the shard now uses its standby.
+	EventFailover FailoverEventType = "failover"
+	// EventFailback: Failback switched the shard back to its primary.
+	EventFailback FailoverEventType = "failback"
+	// EventPrimaryUp: the primary of a shard on its standby is reachable again. The
+	// shard stays on the standby until its writes are reconciled and Failback is called.
+	EventPrimaryUp FailoverEventType = "primary-up"
+	// EventUnavailable: the primary is down and there is no healthy standby to switch to.
+	EventUnavailable FailoverEventType = "unavailable"
+	// EventRecovered: the primary of a shard that had no standby is reachable again.
+	EventRecovered FailoverEventType = "recovered"
+)
+
+// FailoverEvent records a change of a shard's health or active pool.
+type FailoverEvent struct {
+	Shard int
+	Type  FailoverEventType
+	At    time.Time
+	// Err is the last probe error for EventFailover and EventUnavailable.
+	Err error
+}
+
+func (e FailoverEvent) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("shard %d %s at %s: %v", e.Shard, e.Type, e.At.Format(time.RFC3339), e.Err)
+	}
+	return fmt.Sprintf("shard %d %s at %s", e.Shard, e.Type, e.At.Format(time.RFC3339))
+}
+
+// maxFailoverEvents is how many recent events a ShardMonitor keeps for Events.
+const maxFailoverEvents = 100
+
+// ShardMonitor probes every shard primary and switches the shard's active pool to a
+// configured standby after FailAfter consecutive failures. Routers with a monitor send
+// all shard queries to the active pool (see HashRouter.Failover).
+//
+// Failback is manual: the standby accepts writes the primary does not have, so
+// switching back on its own would hide them. Once the primary is up again
+// (EventPrimaryUp), copy the standby's writes onto it and call Failback. Promoting the
+// standby and that copy are left to the database setup.
+type ShardMonitor struct {
+	opts      FailoverOptions
+	primaries []*pgxpool.Pool
+	standbys  []*pgxpool.Pool // by shard index; nil entries have no standby
+	active    []atomic.Pointer[pgxpool.Pool]
+
+	mu     sync.Mutex
+	events []FailoverEvent
+}
+
+// NewShardMonitor builds a monitor for primaries. standbys is indexed like primaries and
+// may be shorter or hold nil entries for shards without a standby. Call Run to start it.
+func NewShardMonitor(primaries, standbys []*pgxpool.Pool, opts FailoverOptions) *ShardMonitor {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = 500 * time.Millisecond
+	}
+	if opts.FailAfter <= 0 {
+		opts.FailAfter = 3
+	}
+	if opts.RecoverAfter <= 0 {
+		opts.RecoverAfter = 3
+	}
+	m := &ShardMonitor{
+		opts:      opts,
+		primaries: primaries,
+		standbys:  make([]*pgxpool.Pool, len(primaries)),
+		active:    make([]atomic.Pointer[pgxpool.Pool], len(primaries)),
+	}
+	copy(m.standbys, standbys)
+	for i, p := range primaries {
+		m.active[i].Store(p)
+	}
+	return m
+}
+
+// Pools returns the pool currently serving each shard.
+func (m *ShardMonitor) Pools() []*pgxpool.Pool {
+	pools := make([]*pgxpool.Pool, len(m.active))
+	for i := range m.active {
+		pools[i] = m.active[i].Load()
+	}
+	return pools
+}
+
+// activePools returns the pools serving each shard, or primaries when m is nil.
+func (m *ShardMonitor) activePools(primaries []*pgxpool.Pool) []*pgxpool.Pool {
+	if m == nil {
+		return primaries
+	}
+	return m.Pools()
+}
+
+// OnStandby reports whether shard is currently served by its standby.
+func (m *ShardMonitor) OnStandby(shard int) bool {
+	return m.active[shard].Load() != m.primaries[shard]
+}
+
+// Events returns the most recent events, oldest first.
+func (m *ShardMonitor) Events() []FailoverEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]FailoverEvent(nil), m.events...)
+}
+
+// Run probes every shard each Interval until ctx is done.
+func (m *ShardMonitor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for s := range m.primaries {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			m.watch(ctx, s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// watch runs the probe loop of one shard, so a hanging shard does not delay the others.
+func (m *ShardMonitor) watch(ctx context.Context, shard int) {
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+	failures, successes := 0, 0
+	down := false // primary considered down (switched to standby, or unavailable)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := m.probe(ctx, m.primaries[shard])
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failures, successes = failures+1, 0
+			if !down && failures >= m.opts.FailAfter {
+				down = true
+				m.failover(ctx, shard, err)
+			} else if down && !m.OnStandby(shard) && m.standbys[shard] != nil && m.probe(ctx, m.standbys[shard]) == nil {
+				// The standby was unhealthy when the primary went down but is up now.
+				m.active[shard].Store(m.standbys[shard])
+				m.emit(FailoverEvent{Shard: shard, Type: EventFailover, At: time.Now(), Err: err})
+			}
+			continue
+		}
+		failures, successes = 0, successes+1
+		if down && successes >= m.opts.RecoverAfter {
+			down = false
+			if m.OnStandby(shard) {
+				m.emit(FailoverEvent{Shard: shard, Type: EventPrimaryUp, At: time.Now()})
+			} else {
+				m.emit(FailoverEvent{Shard: shard, Type: EventRecovered, At: time.Now()})
+			}
+		}
+	}
+}
+
+// Failback switches shard from its standby back to its primary, which must answer a
+// probe. Call it only once the writes the standby accepted are on the primary too:
+// reads go to the primary from then on.
+func (m *ShardMonitor) Failback(ctx context.Context, shard int) error {
+	if shard < 0 || shard >= len(m.primaries) {
+		return fmt.Errorf("no shard %d", shard)
+	}
+	if !m.OnStandby(shard) {
+		return fmt.Errorf("shard %d is not on its standby", shard)
+	}
+	if err := m.probe(ctx, m.primaries[shard]); err != nil {
+		return fmt.Errorf("shard %d primary: %w", shard, err)
+	}
+	m.active[shard].Store(m.primaries[shard])
+	m.emit(FailoverEvent{Shard: shard, Type: EventFailback, At: time.Now()})
+	return nil
+}
+
+// failover switches shard to its standby if it has a healthy one. A shard already on
+// its standby stays there without a new event.
+func (m *ShardMonitor) failover(ctx context.Context, shard int, cause error) {
+	if m.OnStandby(shard) {
+		return
+	}
+	standby := m.standbys[shard]
+	if standby == nil {
+		m.emit(FailoverEvent{Shard: shard, Type: EventUnavailable, At: time.Now(), Err: cause})
+		return
+	}
+	if err := m.probe(ctx, standby); err != nil {
+		m.emit(FailoverEvent{Shard: shard, Type: EventUnavailable, At: time.Now(), Err: fmt.Errorf("%v; standby: %w", cause, err)})
+		return
+	}
+	m.active[shard].Store(standby)
+	m.emit(FailoverEvent{Shard: shard, Type: EventFailover, At: time.Now(), Err: cause})
+}
+
+func (m *ShardMonitor) probe(ctx context.Context, pool *pgxpool.Pool) error {
+	ctx, cancel := context.WithTimeout(ctx, m.opts.ProbeTimeout)
+	defer cancel()
+	return pool.Ping(ctx)
+}
+
+func (m *ShardMonitor) emit(e FailoverEvent) {
+	m.mu.Lock()
+	m.events = append(m.events, e)
+	if len(m.events) > maxFailoverEvents {
+		m.events = m.events[len(m.events)-maxFailoverEvents:]
+	}
+	m.mu.Unlock()
+	if m.opts.OnEvent != nil {
+		m.opts.OnEvent(e)
+	}
+}
@@ -0,0 +1,324 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"partitioning/ready/internal/model"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FanoutStats describes the cost of one fan-out read.
+type FanoutStats struct {
+	// Shards is the number of shards queried.
+	Shards int
+	// Rounds is the number of query rounds; more than 1 means exact mode refetched.
+	Rounds int
+	// Fetched is the number of rows read from all shards.
+	Fetched int
+	// Returned is the number of rows in the merged feed.
+	Returned int
+	// OverFetched is Fetched - Returned: rows transferred only to be discarded by the merge.
+	OverFetched int
+	// Hedged is the number of duplicate shard queries sent by the hedging policy.
+	Hedged int
+}
+
+// FanoutReporter is implemented by routers that can report the cost of a read.
+type FanoutReporter interface {
+	QueryFeedStats(ctx context.Context, userIDs []int64, q FeedQuery) ([]model.Post, FanoutStats, error)
+}
+
+var (
+	_ FanoutReporter = (*HashRouter)(nil)
+	_ FanoutReporter = (*ConsistentHashRouter)(nil)
+	_ FanoutReporter = (*DirectoryRouter)(nil)
+)
+
+// FanoutOptions tunes how HashRouter and ConsistentHashRouter fan a read out to shards.
+type FanoutOptions struct {
+	// Exact guarantees the same top-N as a single table by refetching from shards
+	// whose rows could still make the global cut (see fanOut).
+	Exact bool
+	// AllowPartial enables degraded mode: when a shard fails, the posts of the healthy
+	// shards are still returned, together with a *PartialResultError describing each
+	// shard. Without it the first failing shard fails the whole read and the other
+	// shard queries are cancelled.
+	AllowPartial bool
+	// ShardTimeout bounds every shard query. It is capped to end before the caller's
+	// deadline, so a slow shard times out (and can be reported as partial) instead of
+	// failing the whole request. Zero means only the caller's context applies.
+	ShardTimeout time.Duration
+	// Hedge sends a duplicate query to a shard that is slower than a threshold.
+	Hedge HedgePolicy
+	// Load, if set, counts the queries in flight per shard (see BoundedLoad.SetLoads).
+	Load *ShardLoad
+}
+
+// shardFetch is one shard's query state across fan-out rounds.
+type shardFetch struct {
+	shard     int
+	id        ShardID       // stable name of shard, keys its position in page tokens
+	pool      *pgxpool.Pool // primary or the replica chosen for this read
+	replica   *replica      // nil when reading from the primary
+	userIDs   []int64
+	after     *postKey // position of the last row read from this shard
+	exhausted bool     // the shard returned fewer rows than asked: nothing left
+	state     ShardState
+	err       error
+}
+
+func (t *shardFetch) failed() bool {
+	return t.err != nil
+}
+
+func (t *shardFetch) status() ShardStatus {
+	return ShardStatus{Shard: t.shard, State: t.state, Err: t.err, UserIDs: t.userIDs}
+}
+
+// shardRow is a fetched post tagged with the shard it came from.
+type shardRow struct {
+	post  model.Post
+	shard *shardFetch
+	dups  []*shardFetch // other shards that returned the same post (see mergeRuns)
+}
+
+// fanoutResult is the merged outcome of a fan-out read.
+type fanoutResult struct {
+	rows    []shardRow // top-N in feed order
+	more    bool       // some shard may still have rows after this page
+	stats   FanoutStats
+	targets []*shardFetch
+}
+
+// shardStatuses reports every shard of the read.
+func (r fanoutResult) shardStatuses() []ShardStatus {
+	statuses := make([]ShardStatus, len(r.targets))
+	for i, t := range r.targets {
+		statuses[i] = t.status()
+	}
+	return statuses
+}
+
+// partialErr returns a *PartialResultError if some shard failed, nil otherwise.
+func (r fanoutResult) partialErr() error {
+	for _, t := range r.targets {
+		if t.failed() {
+			return &PartialResultError{Shards: r.shardStatuses()}
+		}
+	}
+	return nil
+}
+
+func (r fanoutResult) posts() []model.Post {
+	posts := make([]model.Post, len(r.rows))
+	for i, row := range r.rows {
+		posts[i] = row.post
+	}
+	return posts
+}
+
+// page builds the FeedPage for the result. Every shard that contributed rows resumes
+// after its own last returned row; the others keep their previous position. A failed
+// shard without one restarts from the top, so its posts are not skipped.
+func (r fanoutResult) page(prev *pageCursor) FeedPage {
+	page := FeedPage{Posts: r.posts(), Shards: r.shardStatuses()}
+	if !r.more || len(r.rows) == 0 {
+		return page
+	}
+	next := pageCursor{Last: keyOf(r.rows[len(r.rows)-1].post), Shards: make(map[string]postKey)}
+	if prev != nil {
+		for s, k := range prev.Shards {
+			next.Shards[s] = k
+		}
+	}
+	for _, t := range r.targets {
+		if _, ok := next.Shards[string(t.id)]; t.failed() && !ok {
+			next.Shards[string(t.id)] = postKey{}
+		}
+	}
+	for _, row := range r.rows {
+		next.Shards[string(row.shard.id)] = keyOf(row.post)
+		for _, d := range row.dups {
+			next.Shards[string(d.id)] = keyOf(row.post)
+		}
+	}
+	page.NextPageToken = next.encode()
+	return page
+}
+
+// fanOut queries every target in parallel and merges rows into the global top-N.
+//
+// Each shard first gets LIMIT ceil(limit/active). That is enough on average but not
+// when one shard holds most of the newest posts. In exact mode the merge then checks,
+// for every shard that may have more rows, where its last row ranks globally: if it
+// is inside the top-N, the shard is asked for the rows after it (keyset), at most as
+// many as could still make the cut. This repeats until no shard can contribute, so
+// the result equals a single-table ORDER BY created_at DESC, id DESC LIMIT N.
+//
+// Without AllowPartial, a failing shard cancels the other shard queries and fails
+// the read. With it, failed shards are dropped from further rounds and reported in
+// the result (see fanoutResult.partialErr).
+func fanOut(ctx context.Context, table string, targets []*shardFetch, fq FeedQuery, opts FanoutOptions, lat *shardLatencies) (fanoutResult, error) {
+	res := fanoutResult{stats: FanoutStats{Shards: len(targets)}, targets: targets}
+	if len(targets) == 0 {
+		return res, nil
+	}
+	limit := fq.Limit
+	perLimit := (limit + len(targets) - 1) / len(targets) // ceil(limit/active)
+	pending := make(map[*shardFetch]int, len(targets))
+	for _, t := range targets {
+		pending[t] = perLimit
+	}
+
+	// rows holds the merged top-N so far; anything below the cut can never come back.
+	var rows []shardRow
+	for len(pending) > 0 {
+		res.stats.Rounds++
+		runs, hedged, err := fetchRound(ctx, table, fq, pending, opts, lat)
+		res.stats.Hedged += hedged
+		if err != nil {
+			return res, err
+		}
+		total := len(rows)
+		for _, run := range runs {
+			res.stats.Fetched += len(run)
+			total += len(run)
+		}
+		if total > limit {
+			res.more = true
+		}
+		// Each shard's rows arrive already ordered, so a k-way heap merge replaces a full sort.
+		rows = mergeRuns(append(runs, rows), limit)
+		if !opts.Exact {
+			break
+		}
+		pending = refetchPlan(rows, limit)
+	}
+
+	for _, t := range targets {
+		if !t.exhausted || t.failed() {
+			res.more = true
+		}
+	}
+	res.rows = rows
+	res.stats.Returned = len(rows)
+	res.stats.OverFetched = res.stats.Fetched - res.stats.Returned
+	return res, nil
+}
+
+// refetchPlan returns how many more rows each shard must be asked for.
+// rows is the merged top-N so far. A shard needs more only if it is not exhausted,
+// none of its rows fell below the cut, and its last row sits at global rank
+// i < limit-1: then up to limit-1-i of its following rows could still make the top-N.
+func refetchPlan(rows []shardRow, limit int) map[*shardFetch]int {
+	last := make(map[*shardFetch]int)
+	for i, r := range rows {
+		last[r.shard] = i
+		for _, d := range r.dups {
+			last[d] = i
+		}
+	}
+	plan := make(map[*shardFetch]int)
+	for t, i := range last {
+		if t.exhausted || !keyOf(rows[i].post).equal(*t.after) {
+			continue
+		}
+		if slack := limit - 1 - i; slack > 0 {
+			plan[t] = slack
+		}
+	}
+	return plan
+}
+
+// fetchRound runs one query per pending shard concurrently, asking each for n rows
+// after its current position, and returns the rows read as one ordered run per shard.
+// On the first failure it cancels the other queries and returns the error, unless
+// AllowPartial is set: then the failed shard is marked and left out of later rounds.
+// It also returns how many hedged queries were sent.
+func fetchRound(ctx context.Context, table string, fq FeedQuery, pending map[*shardFetch]int, opts FanoutOptions, lat *shardLatencies) ([][]shardRow, int, error) {
+	type shardResult struct {
+		t      *shardFetch
+		posts  []model.Post
+		hedged bool
+		err    error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan shardResult, len(pending))
+	for t, n := range pending {
+		q := fq
+		q.Limit = n
+		go func(t *shardFetch, q FeedQuery) {
+			sql, args := feedSQL(table, t.userIDs, q, t.after)
+			ps, hedged, err := queryShard(ctx, t, sql, args, opts, lat)
+			if err != nil {
+				err = fmt.Errorf("shard %d: %w", t.shard, err)
+			}
+			results <- shardResult{t: t, posts: ps, hedged: hedged, err: err}
+		}(t, q)
+	}
+
+	var out [][]shardRow
+	hedged := 0
+	for range pending {
+		r := <-results
+		if r.hedged {
+			hedged++
+		}
+		if r.err != nil {
+			r.t.err, r.t.state = r.err, classifyShardErr(r.err)
+			r.t.exhausted = true
+			if opts.AllowPartial {
+				continue
+			}
+			// Hard failure: the deferred cancel stops the remaining shard queries.
+			markSkipped(pending)
+			return nil, hedged, r.err
+		}
+		r.t.state = ShardOK
+		if len(r.posts) < pending[r.t] {
+			r.t.exhausted = true
+		}
+		if len(r.posts) > 0 {
+			k := keyOf(r.posts[len(r.posts)-1])
+			r.t.after = &k
+		}
+		run := make([]shardRow, len(r.posts))
+		for i, p := range r.posts {
+			run[i] = shardRow{post: p, shard: r.t}
+		}
+		out = append(out, run)
+	}
+	return out, hedged, nil
+}
+
+// markSkipped marks shards that have not reported yet as skipped.
+func markSkipped(pending map[*shardFetch]int) {
+	for t := range pending {
+		if t.state == "" {
+			t.state, t.err = ShardSkipped, context.Canceled
+		}
+	}
+}
+
+// shardTargets turns a shard -> userIDs grouping into fan-out targets ordered by shard,
+// skipping shards without users. With a cursor, each shard starts at its saved position.
+// Each target reads from the pool chosen by reads (a replica or the primary in pools).
+// shardIDs names the shards by index (see shardIDAt).
+func shardTargets(ctx context.Context, perShard map[int][]int64, pools []*pgxpool.Pool, shardIDs []ShardID, reads *ReadReplicas, cur *pageCursor) []*shardFetch {
+	targets := make([]*shardFetch, 0, len(perShard))
+	for s, ids := range perShard {
+		if len(ids) == 0 {
+			continue
+		}
+		id := shardIDAt(shardIDs, s)
+		pool, rep := reads.pick(ctx, s, id, pools[s])
+		targets = append(targets, &shardFetch{shard: s, id: id, pool: pool, replica: rep, userIDs: ids, after: cur.shardPos(id)})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].shard < targets[j].shard })
+	return targets
+}
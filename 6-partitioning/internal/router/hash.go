@@ -3,8 +3,6 @@ package router
 import (
 	"context"
 	"fmt"
-	"sort"
-	"time"
 
 	"partitioning/ready/internal/model"
 
@@ -12,115 +10,144 @@ import (
 )
 
 // HashRouter dispatches queries to multiple shards and merges results.
-// Shard selection rule: shard = user_id % 3
+// Shard selection rule: shard = Jump(HashUser(user_id), len(Shards)), a drop-in
+// replacement for user_id % N that works for any number of shards.
 //
-// Limitations of modulo-based sharding:
-// - Rebalancing: when shard count changes, N changes => most keys remap; requires large data moves.
+// Limitations of hash-bucket sharding:
+// - Rebalancing: appending a shard moves ~1/N of the users; removing any other remaps most.
 // - No indirection: routing is tightly coupled to N; no shard-map to remap subsets.
 // - Hotspots: no virtual buckets to smooth key skew; hot users can overload a shard.
 // - Migrations: no double-read/write path; rolling migrations are hard without downtime.
-// - Resilience: no notion of replicas/failover in routing.
+// - Resilience: a failed shard switches to its standby (see Failover), but failback is manual.
 type HashRouter struct {
 	Shards []*pgxpool.Pool
+	// IDs assigns post IDs on insert. It is required for writes, with a node ID no other
+	// writer uses (see NodeID).
+	IDs *IDGenerator
+	// Reads routes shard reads to replicas (default nil: primaries only). Writes always
+	// go to the active shard pool.
+	Reads *ReadReplicas
+	// Failover, if set, replaces a failed shard's pool by its standby (see ShardMonitor).
+	Failover *ShardMonitor
+	// FanoutOptions tunes the fan-out: exact merge, partial results, timeouts, hedging.
+	FanoutOptions
+
+	lat shardLatencies // recent per-shard latencies for percentile hedging
+}
+
+// HashUserID is a tiny helper exposing the shard mapping for a given shard count.
+func HashUserID(id int64, shards int) int {
+	return Jump(HashUser(id), shards)
 }
 
-// HashUserID is a tiny helper exposing the shard mapping.
-func HashUserID(id int64) int {
-	return int(id % 3)
+// ShardFor returns the index of the shard owning userID.
+func (r *HashRouter) ShardFor(userID int64) int {
+	return HashUserID(userID, len(r.Shards))
 }
 
-// GetFeed groups userIDs by shard, runs queries in parallel, merges rows,
-// and returns the top-N by created_at DESC across all shards (global sort).
+// ShardOf implements ShardLocator with jump hashing.
+func (r *HashRouter) ShardOf(_ context.Context, userID int64) (int, error) {
+	return r.ShardFor(userID), nil
+}
+
+// GetFeed runs the feed query with the window carried by ctx (see QueryFromContext).
 func (r *HashRouter) GetFeed(ctx context.Context, userIDs []int64, limit int) ([]model.Post, error) {
-	if len(r.Shards) != 3 {
-		return nil, fmt.Errorf("expected 3 shards, got %d", len(r.Shards))
-	}
-	// Group userIDs per shard
-	perShard := map[int][]int64{
-		0: {},
-		1: {},
-		2: {},
+	return r.QueryFeed(ctx, userIDs, QueryFromContext(ctx, limit))
+}
+
+// QueryFeed groups userIDs by shard, runs queries in parallel, merges rows,
+// and returns the top-N by created_at DESC across all shards (global heap merge).
+// With AllowPartial, a failing shard yields the other shards' posts and a *PartialResultError.
+func (r *HashRouter) QueryFeed(ctx context.Context, userIDs []int64, fq FeedQuery) ([]model.Post, error) {
+	res, _, err := r.query(ctx, userIDs, fq)
+	if err != nil {
+		return nil, err
 	}
-	for _, id := range userIDs {
-		perShard[HashUserID(id)] = append(perShard[HashUserID(id)], id)
+	return res.posts(), res.partialErr()
+}
+
+// QueryFeedStats is QueryFeed that also reports how many rows the fan-out read.
+func (r *HashRouter) QueryFeedStats(ctx context.Context, userIDs []int64, fq FeedQuery) ([]model.Post, FanoutStats, error) {
+	res, _, err := r.query(ctx, userIDs, fq)
+	if err != nil {
+		return nil, res.stats, err
 	}
+	return res.posts(), res.stats, res.partialErr()
+}
 
-	type shardResult struct {
-		posts []model.Post
-		err   error
+// QueryFeedPage returns one page of fq. The next token stores the position of the
+// last post returned from every shard, so each shard resumes exactly where it stopped.
+func (r *HashRouter) QueryFeedPage(ctx context.Context, userIDs []int64, fq FeedQuery) (FeedPage, error) {
+	res, cur, err := r.query(ctx, userIDs, fq)
+	if err != nil {
+		return FeedPage{}, err
 	}
-	results := make(chan shardResult, 3)
-
-	cutoff := time.Now().Add(-7 * 24 * time.Hour)
-	q := `
- 	SELECT id, user_id, created_at, content
- 	FROM posts_hash
- 	WHERE user_id = ANY($1) AND created_at >= $2
- 	ORDER BY created_at DESC
- 	LIMIT $3;`
-
-	// Distribute the global LIMIT across active shards to reduce over-fetching.
-	active := 0
-	for _, ids := range perShard {
-		if len(ids) > 0 {
-			active++
-		}
+	return res.page(cur), res.partialErr()
+}
+
+func (r *HashRouter) query(ctx context.Context, userIDs []int64, fq FeedQuery) (fanoutResult, *pageCursor, error) {
+	targets, cur, err := r.targets(ctx, userIDs, fq)
+	if err != nil {
+		return fanoutResult{}, nil, err
 	}
-	perLimit := limit
-	if active > 1 {
-		perLimit = (limit + active - 1) / active // ceil(limit/active)
+	// Fan out to shards concurrently; the global LIMIT is distributed across active shards.
+	res, err := fanOut(ctx, "posts_hash", targets, fq, r.FanoutOptions, &r.lat)
+	return res, cur, err
+}
+
+// IterFeed streams fq from all shards through a heap merge (see FeedIterator).
+func (r *HashRouter) IterFeed(ctx context.Context, userIDs []int64, fq FeedQuery) (*FeedIterator, error) {
+	targets, cur, err := r.targets(ctx, userIDs, fq)
+	if err != nil {
+		return nil, err
 	}
+	return openIterator(ctx, "posts_hash", targets, fq, cur, r.FanoutOptions)
+}
 
-	// Fan out to shards concurrently
-	for shardIdx, ids := range perShard {
-		if len(ids) == 0 {
-			// No users on this shard; push empty result
-			results <- shardResult{posts: nil, err: nil}
-			continue
-		}
-		pool := r.Shards[shardIdx]
-		go func(ids []int64, pool *pgxpool.Pool) {
-			rows, err := pool.Query(ctx, q, ids, cutoff, perLimit)
-			if err != nil {
-				results <- shardResult{err: fmt.Errorf("shard query: %w", err)}
-				return
-			}
-			defer rows.Close()
-			var ps []model.Post
-			for rows.Next() {
-				var p model.Post
-				if err := rows.Scan(&p.ID, &p.UserID, &p.CreatedAt, &p.Content); err != nil {
-					results <- shardResult{err: fmt.Errorf("scan: %w", err)}
-					return
-				}
-				ps = append(ps, p)
-			}
-			if err := rows.Err(); err != nil {
-				results <- shardResult{err: err}
-				return
-			}
-			results <- shardResult{posts: ps}
-		}(ids, pool)
+// targets validates fq and groups userIDs per shard, starting each shard at its
+// position from fq.PageToken.
+func (r *HashRouter) targets(ctx context.Context, userIDs []int64, fq FeedQuery) ([]*shardFetch, *pageCursor, error) {
+	if err := fq.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if len(r.Shards) == 0 {
+		return nil, nil, fmt.Errorf("router not initialized")
+	}
+	cur, err := decodeCursor(fq.PageToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Group userIDs per shard
+	perShard := make(map[int][]int64, len(r.Shards))
+	for _, id := range userIDs {
+		s := r.ShardFor(id)
+		perShard[s] = append(perShard[s], id)
 	}
+	return shardTargets(ctx, perShard, r.Failover.activePools(r.Shards), nil, r.Reads, cur), cur, nil
+}
 
-	// Collect and merge results from all shards
-	var merged []model.Post
-	for i := 0; i < 3; i++ {
-		r := <-results
-		if r.err != nil {
-			return nil, r.err
-		}
-		if len(r.posts) > 0 {
-			merged = append(merged, r.posts...)
-		}
+// InsertPost stores p on the shard owning p.UserID and returns it with its ID.
+func (r *HashRouter) InsertPost(ctx context.Context, p model.Post) (model.Post, error) {
+	return firstPost(r.InsertPosts(ctx, []model.Post{p}))
+}
+
+// InsertPosts groups posts by shard and writes one batch per shard.
+func (r *HashRouter) InsertPosts(ctx context.Context, posts []model.Post) ([]model.Post, error) {
+	if len(r.Shards) == 0 {
+		return nil, fmt.Errorf("router not initialized")
 	}
+	return insertSharded(ctx, r.Failover.activePools(r.Shards), nil, "posts_hash", r.IDs, r.ShardFor, posts)
+}
 
-	// Global sort and top-N cut to respect the limit across shards
-	sort.Slice(merged, func(i, j int) bool {
-		return merged[i].CreatedAt.After(merged[j].CreatedAt)
-	})
-	if len(merged) > limit {
-		merged = merged[:limit]
+// DeletePost removes a post from the shard owning userID.
+func (r *HashRouter) DeletePost(ctx context.Context, userID, postID int64) error {
+	if len(r.Shards) == 0 {
+		return fmt.Errorf("router not initialized")
+	}
+	s := r.ShardFor(userID)
+	if err := deletePost(ctx, r.Failover.activePools(r.Shards)[s], "posts_hash", userID, postID); err != nil {
+		return err
 	}
-	return merged, nil
+	sessionFrom(ctx).wrote(shardIDAt(nil, s))
+	return nil
 }
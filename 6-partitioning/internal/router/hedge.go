@@ -0,0 +1,187 @@
+package router
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"partitioning/ready/internal/model"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// HedgePolicy configures hedged shard requests: if a shard has not answered after a
+// delay, the same query is sent a second time and whichever answer arrives first wins.
+// This trims the latency tail caused by one slow shard at the cost of extra load.
+type HedgePolicy struct {
+	// After is a fixed hedge delay. Zero disables hedging unless Percentile is set.
+	After time.Duration
+	// Percentile (0 < p < 1), if set, derives the delay from the shard's recent
+	// latencies, e.g. 0.95 hedges requests slower than the shard's p95. After is
+	// used until enough samples have been collected.
+	Percentile float64
+	// Pools optionally holds, per shard index, the pool that receives the duplicate
+	// (typically a replica). A missing or nil entry retries on the shard's own pool.
+	Pools []*pgxpool.Pool
+}
+
+// delay returns how long to wait before hedging a query to shard, and false if
+// there is no delay to use yet.
+func (h HedgePolicy) delay(lat *shardLatencies, shard int) (time.Duration, bool) {
+	if h.Percentile > 0 && lat != nil {
+		if d, ok := lat.percentile(shard, h.Percentile); ok {
+			return d, true
+		}
+	}
+	return h.After, h.After > 0
+}
+
+// enabled reports whether the policy hedges at all.
+func (h HedgePolicy) enabled() bool {
+	return h.After > 0 || h.Percentile > 0
+}
+
+// target returns the pool that receives the hedged duplicate for shard.
+func (h HedgePolicy) target(shard int, primary *pgxpool.Pool) *pgxpool.Pool {
+	if shard < len(h.Pools) && h.Pools[shard] != nil {
+		return h.Pools[shard]
+	}
+	return primary
+}
+
+// latencyWindow is the number of recent samples kept per shard.
+const latencyWindow = 256
+
+// minLatencySamples is how many samples a shard needs before its percentile is trusted.
+const minLatencySamples = 20
+
+// shardLatencies keeps a sliding window of successful query latencies per shard.
+// The zero value is ready to use.
+type shardLatencies struct {
+	mu      sync.Mutex
+	samples map[int][]time.Duration
+	next    map[int]int
+}
+
+func (l *shardLatencies) observe(shard int, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.samples == nil {
+		l.samples = make(map[int][]time.Duration)
+		l.next = make(map[int]int)
+	}
+	s := l.samples[shard]
+	if len(s) < latencyWindow {
+		l.samples[shard] = append(s, d)
+		return
+	}
+	s[l.next[shard]] = d
+	l.next[shard] = (l.next[shard] + 1) % latencyWindow
+}
+
+func (l *shardLatencies) percentile(shard int, p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	s := append([]time.Duration(nil), l.samples[shard]...)
+	l.mu.Unlock()
+	if len(s) < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	i := int(float64(len(s)) * p)
+	if i >= len(s) {
+		i = len(s) - 1
+	}
+	return s[i], true
+}
+
+// shardContext derives the context for one shard query. With a ShardTimeout the
+// query gets its own deadline (see shardDeadline).
+func shardContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := shardDeadline(ctx, timeout)
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// shardDeadline returns the deadline of one shard query with a ShardTimeout, capped so
+// that it ends before the caller's deadline with a tenth of the remaining budget left
+// to merge and return (partial) results. It returns false without a timeout.
+func shardDeadline(ctx context.Context, timeout time.Duration) (time.Time, bool) {
+	if timeout <= 0 {
+		return time.Time{}, false
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok {
+		if capped := d.Add(-time.Until(d) / 10); capped.Before(deadline) {
+			deadline = capped
+		}
+	}
+	return deadline, true
+}
+
+// queryShard runs one shard query under the per-shard deadline and, if configured,
+// hedges it. It reports whether a hedge was sent.
+func queryShard(ctx context.Context, t *shardFetch, sql string, args []any, opts FanoutOptions, lat *shardLatencies) ([]model.Post, bool, error) {
+	ctx, cancel := shardContext(ctx, opts.ShardTimeout)
+	defer cancel()
+
+	run := func(ctx context.Context, pool *pgxpool.Pool) ([]model.Post, error) {
+		if pool == t.pool {
+			t.replica.begin()
+			defer t.replica.end()
+		}
+		opts.Load.begin(t.shard)
+		defer opts.Load.end(t.shard)
+		start := time.Now()
+		rows, err := pool.Query(ctx, sql, args...)
+		if err != nil {
+			return nil, err
+		}
+		ps, err := scanPosts(rows)
+		if err == nil && lat != nil {
+			lat.observe(t.shard, time.Since(start))
+		}
+		return ps, err
+	}
+
+	delay, hedge := opts.Hedge.delay(lat, t.shard)
+	if !hedge {
+		ps, err := run(ctx, t.pool)
+		return ps, false, err
+	}
+
+	// Both attempts share ctx: returning cancels the loser.
+	type attempt struct {
+		posts []model.Post
+		err   error
+	}
+	out := make(chan attempt, 2)
+	launch := func(pool *pgxpool.Pool) {
+		go func() {
+			ps, err := run(ctx, pool)
+			out <- attempt{posts: ps, err: err}
+		}()
+	}
+	launch(t.pool)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	inflight, hedged := 1, false
+	select {
+	case a := <-out:
+		return a.posts, false, a.err
+	case <-timer.C:
+		launch(opts.Hedge.target(t.shard, t.pool))
+		inflight, hedged = 2, true
+	}
+	var err error
+	for ; inflight > 0; inflight-- {
+		a := <-out
+		if a.err == nil {
+			return a.posts, hedged, nil
+		}
+		err = a.err
+	}
+	return nil, hedged, err
+}
@@ -0,0 +1,80 @@
+package router
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idEpoch is the custom epoch for generated post IDs (2024-01-01 UTC).
+var idEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// IDGenerator hands out post IDs for sharded tables.
+// Per-shard BIGSERIAL sequences overlap, so the same ID would exist on several shards
+// and rows could not be moved between shards without renumbering them.
+// IDs are snowflake-style: 41 bits of milliseconds since idEpoch, 10 bits of node,
+// 12 bits of per-millisecond sequence. They are unique as long as nodes differ and
+// roughly increase with time.
+type IDGenerator struct {
+	mu     sync.Mutex
+	node   int64
+	lastMS int64
+	seq    int64
+}
+
+// NewIDGenerator creates a generator for the given node (only the low 10 bits are used).
+func NewIDGenerator(node int64) *IDGenerator {
+	return &IDGenerator{node: node & 0x3ff}
+}
+
+// NodeIDEnv is the environment variable holding a writer's node ID.
+const NodeIDEnv = "NODE_ID"
+
+// MaxNodeID is the largest node ID an IDGenerator can encode.
+const MaxNodeID = 1<<10 - 1
+
+// NodeID returns the node ID of this process: node if it is not negative (e.g. a -node
+// flag), otherwise NODE_ID. Two writers with the same node can issue the same ID in the
+// same millisecond, so there is no default: every writer must be given its own node.
+func NodeID(node int64) (int64, error) {
+	if node < 0 {
+		v := strings.TrimSpace(os.Getenv(NodeIDEnv))
+		if v == "" {
+			return 0, fmt.Errorf("no node ID: set -node or %s to a value unique among writers (0..%d)", NodeIDEnv, MaxNodeID)
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s=%q is not a node ID (0..%d)", NodeIDEnv, v, MaxNodeID)
+		}
+		node = n
+	}
+	if node > MaxNodeID {
+		return 0, fmt.Errorf("node ID %d out of range 0..%d", node, MaxNodeID)
+	}
+	return node, nil
+}
+
+// Next returns a new unique ID.
+func (g *IDGenerator) Next() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := time.Since(idEpoch).Milliseconds()
+	if ms < g.lastMS {
+		// Clock went backwards: keep issuing from the last timestamp.
+		ms = g.lastMS
+	}
+	if ms == g.lastMS {
+		g.seq = (g.seq + 1) & 0xfff
+		if g.seq == 0 {
+			// Sequence exhausted for this millisecond; borrow the next one.
+			ms++
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMS = ms
+	return ms<<22 | g.node<<12 | g.seq
+}
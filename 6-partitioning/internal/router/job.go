@@ -0,0 +1,515 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	schema "partitioning/ready/sql"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// JobStatus is the state of a migration job as a whole.
+type JobStatus string
+
+const (
+	JobRunning JobStatus = "running"
+	JobPaused  JobStatus = "paused"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// UnitState is the state of one unit of a migration job, a hash range that moves from
+// one shard to another:
+//
+//	pending    not started yet, or interrupted and to be run again
+//	copying    MoveRows moves the range batch by batch: copy, verify, delete
+//	verifying  the range is checked to be empty on its source
+//	done       every row of the range is on its new owner
+//	failed     the move stopped with an error (see JobStore.Resume)
+type UnitState string
+
+const (
+	UnitPending   UnitState = "pending"
+	UnitCopying   UnitState = "copying"
+	UnitVerifying UnitState = "verifying"
+	UnitDone      UnitState = "done"
+	UnitFailed    UnitState = "failed"
+)
+
+// ErrJobPaused is wrapped by JobStore.Run when the job is or gets paused.
+var ErrJobPaused = errors.New("migration job paused")
+
+// JobSpec describes a migration job: moving Table from ring From to ring To.
+type JobSpec struct {
+	Name     string
+	Table    string // default: posts_hash
+	From, To *ShardRing
+	// RowsPerSecond caps the rows moved per second by the whole job, split evenly
+	// over the units in flight (0: no limit).
+	RowsPerSecond int
+	// Concurrency is the number of units moved at the same time (default: 1).
+	Concurrency int
+	// BatchSize is the number of rows per copy/delete batch (default: 1000).
+	BatchSize int
+}
+
+// JobOptions tunes a JobStore.
+type JobOptions struct {
+	// Poll is how often Run checks whether the job was paused (default: 1s).
+	Poll time.Duration
+	// Attempts bounds how often Run moves a unit whose copy does not verify, e.g.
+	// because of concurrent writes, before marking it failed (default: 3).
+	Attempts int
+}
+
+// EnsureJobTables creates the tables of a JobStore on pool if they do not exist, by
+// running sql/migration_jobs_schema.sql.
+func EnsureJobTables(ctx context.Context, pool *pgxpool.Pool) error {
+	if _, err := pool.Exec(ctx, schema.MigrationJobs); err != nil {
+		return fmt.Errorf("ensure migration job tables: %w", err)
+	}
+	return nil
+}
+
+// JobStore keeps migration jobs in the tables of EnsureJobTables. Every
+// range of From.Diff(To) is a unit with its own UnitState, so a job that crashed,
+// failed or was paused continues with the units not done yet. Moving a unit again is
+// safe: MoveRows only takes the rows still on the source, and rows keep their IDs, so
+// rows already on the destination are not inserted twice.
+//
+// Like cmd/migrate -from -to, a job is not online: run it while the moved users are
+// idle, or use Rebalancer.
+type JobStore struct {
+	pool    *pgxpool.Pool
+	resolve PoolResolver
+	opts    JobOptions
+}
+
+// NewJobStore returns a store of jobs on pool. resolve supplies the pools of the
+// shards on the jobs' rings, e.g. Topology.ShardPool.
+func NewJobStore(pool *pgxpool.Pool, resolve PoolResolver, opts JobOptions) *JobStore {
+	if opts.Poll <= 0 {
+		opts.Poll = time.Second
+	}
+	if opts.Attempts <= 0 {
+		opts.Attempts = 3
+	}
+	return &JobStore{pool: pool, resolve: resolve, opts: opts}
+}
+
+// Create stores job spec as running with one pending unit per moved range. If a job
+// with the same name, table and ring epochs exists, Create leaves it as is, so running
+// the same command again resumes it; a job with the name for other rings is an error.
+func (s *JobStore) Create(ctx context.Context, spec JobSpec) error {
+	if spec.Name == "" {
+		return fmt.Errorf("migration job: empty name")
+	}
+	if spec.Table == "" {
+		spec.Table = "posts_hash"
+	}
+	if spec.Concurrency <= 0 {
+		spec.Concurrency = 1
+	}
+	if spec.BatchSize <= 0 {
+		spec.BatchSize = 1000
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("create migration job %s: %w", spec.Name, err)
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, `
+	INSERT INTO migration_jobs (name, table_name, status, from_ring, to_ring, rows_per_second, concurrency, batch_size)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (name) DO NOTHING`,
+		spec.Name, spec.Table, string(JobRunning), spec.From.Spec(), spec.To.Spec(), spec.RowsPerSecond, spec.Concurrency, spec.BatchSize)
+	if err != nil {
+		return fmt.Errorf("create migration job %s: %w", spec.Name, err)
+	}
+	if tag.RowsAffected() == 0 {
+		var table string
+		var from, to RingSpec
+		err := tx.QueryRow(ctx, `SELECT table_name, from_ring, to_ring FROM migration_jobs WHERE name = $1`, spec.Name).Scan(&table, &from, &to)
+		if err != nil {
+			return fmt.Errorf("create migration job %s: %w", spec.Name, err)
+		}
+		if table != spec.Table || from.Epoch != spec.From.Version() || to.Epoch != spec.To.Version() {
+			return fmt.Errorf("migration job %s already moves %s from epoch %d to %d", spec.Name, table, from.Epoch, to.Epoch)
+		}
+		return nil
+	}
+
+	moves := spec.From.Diff(spec.To)
+	seqs := make([]int32, len(moves))
+	starts := make([]int64, len(moves))
+	ends := make([]*int64, len(moves))
+	srcs := make([]string, len(moves))
+	dsts := make([]string, len(moves))
+	for i, m := range moves {
+		seqs[i], starts[i] = int32(i), UserHashKey(m.Start)
+		if m.End != 0 {
+			end := UserHashKey(m.End)
+			ends[i] = &end
+		}
+		srcs[i], dsts[i] = string(spec.From.ID(m.From)), string(spec.To.ID(m.To))
+	}
+	_, err = tx.Exec(ctx, `
+	INSERT INTO migration_units (job, seq, hash_from, hash_to, src, dst)
+	SELECT $1, * FROM unnest($2::int[], $3::bigint[], $4::bigint[], $5::text[], $6::text[])`,
+		spec.Name, seqs, starts, ends, srcs, dsts)
+	if err != nil {
+		return fmt.Errorf("create migration job %s: %w", spec.Name, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("create migration job %s: %w", spec.Name, err)
+	}
+	return nil
+}
+
+// Pause asks a running job to stop: Run finishes no further batch, puts the units in
+// flight back to pending and returns ErrJobPaused within JobOptions.Poll.
+func (s *JobStore) Pause(ctx context.Context, name string) error {
+	tag, err := s.pool.Exec(ctx, `UPDATE migration_jobs SET status = $2, updated_at = now() WHERE name = $1 AND status = $3`,
+		name, string(JobPaused), string(JobRunning))
+	if err != nil {
+		return fmt.Errorf("pause migration job %s: %w", name, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("pause migration job %s: no such running job", name)
+	}
+	return nil
+}
+
+// Resume marks a paused or failed job running again and its failed units pending, so
+// the next Run retries them. Resuming a job that is done changes nothing.
+func (s *JobStore) Resume(ctx context.Context, name string) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("resume migration job %s: %w", name, err)
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, `
+	UPDATE migration_jobs SET status = CASE WHEN status = $2 THEN status ELSE $3 END, updated_at = now()
+	WHERE name = $1`, name, string(JobDone), string(JobRunning))
+	if err != nil {
+		return fmt.Errorf("resume migration job %s: %w", name, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("resume migration job %s: no such job", name)
+	}
+	if _, err := tx.Exec(ctx, `UPDATE migration_units SET state = $2, error = NULL, updated_at = now() WHERE job = $1 AND state = $3`,
+		name, string(UnitPending), string(UnitFailed)); err != nil {
+		return fmt.Errorf("resume migration job %s: %w", name, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("resume migration job %s: %w", name, err)
+	}
+	return nil
+}
+
+// JobProgress is the state of a job and its units.
+type JobProgress struct {
+	Name      string
+	Table     string
+	Status    JobStatus
+	FromEpoch uint64
+	ToEpoch   uint64
+	Units     map[UnitState]int
+	Rows      int64    // rows moved by finished attempts
+	Errors    []string // one per failed unit
+	UpdatedAt time.Time
+}
+
+// Progress reads the state of job name.
+func (s *JobStore) Progress(ctx context.Context, name string) (*JobProgress, error) {
+	p := &JobProgress{Name: name, Units: map[UnitState]int{}}
+	var status string
+	var from, to RingSpec
+	err := s.pool.QueryRow(ctx, `SELECT table_name, status, from_ring, to_ring, updated_at FROM migration_jobs WHERE name = $1`, name).
+		Scan(&p.Table, &status, &from, &to, &p.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("migration job %s: no such job", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("migration job %s: %w", name, err)
+	}
+	p.Status, p.FromEpoch, p.ToEpoch = JobStatus(status), from.Epoch, to.Epoch
+	rows, err := s.pool.Query(ctx, `SELECT seq, hash_from, hash_to, src, dst, state, rows, coalesce(error, '') FROM migration_units WHERE job = $1 ORDER BY seq`, name)
+	if err != nil {
+		return nil, fmt.Errorf("migration job %s: %w", name, err)
+	}
+	var u jobUnit
+	var state, unitErr string
+	var moved int64
+	_, err = pgx.ForEachRow(rows, []any{&u.seq, &u.start, &u.end, &u.src, &u.dst, &state, &moved, &unitErr}, func() error {
+		p.Units[UnitState(state)]++
+		p.Rows += moved
+		if UnitState(state) == UnitFailed {
+			r := u.hashRange()
+			p.Errors = append(p.Errors, fmt.Sprintf("unit %d [%d, %d) %s -> %s: %s", u.seq, r.Start, r.End, u.src, u.dst, unitErr))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("migration job %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// jobUnit is a claimed unit of a job.
+type jobUnit struct {
+	seq      int
+	start    int64  // user_hash
+	end      *int64 // user_hash; nil: end of the keyspace
+	src, dst string
+}
+
+// hashRange returns the ring keys of the unit's user_hash bounds.
+func (u jobUnit) hashRange() HashRange {
+	r := HashRange{Start: uint64(u.start) ^ 1<<63}
+	if u.end != nil {
+		r.End = uint64(*u.end) ^ 1<<63
+	}
+	return r
+}
+
+// job is a stored job as Run uses it.
+type job struct {
+	name, table       string
+	status            JobStatus
+	from, to          *ShardRing
+	rate, concurrency int
+	batch             int
+}
+
+func (s *JobStore) load(ctx context.Context, name string) (*job, error) {
+	j := &job{name: name}
+	var status string
+	var from, to []byte
+	err := s.pool.QueryRow(ctx, `
+	SELECT table_name, status, from_ring, to_ring, rows_per_second, concurrency, batch_size
+	FROM migration_jobs WHERE name = $1`, name).Scan(&j.table, &status, &from, &to, &j.rate, &j.concurrency, &j.batch)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("migration job %s: no such job", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("migration job %s: %w", name, err)
+	}
+	j.status = JobStatus(status)
+	if j.from, err = ringFromJSON(from, s.resolve); err != nil {
+		return nil, fmt.Errorf("migration job %s: from: %w", name, err)
+	}
+	if j.to, err = ringFromJSON(to, s.resolve); err != nil {
+		return nil, fmt.Errorf("migration job %s: to: %w", name, err)
+	}
+	return j, nil
+}
+
+// Run moves the units of job name that are not done, JobSpec.Concurrency at a time in
+// range order, and returns once none is pending. A unit that fails is marked failed
+// with its error and the others go on; Run then marks the job failed and returns an
+// error. Run returns ErrJobPaused if the job is paused, before or while it runs. Only
+// one Run per job works at a time (a session advisory lock), so units left copying or
+// verifying by an interrupted Run can safely start over.
+func (s *JobStore) Run(ctx context.Context, name string) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("migration job %s: %w", name, err)
+	}
+	defer conn.Release()
+	lock := "migration_job:" + name
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(hashtextextended($1, 0))`, lock).Scan(&locked); err != nil {
+		return fmt.Errorf("migration job %s: %w", name, err)
+	}
+	if !locked {
+		return fmt.Errorf("migration job %s is already running", name)
+	}
+	defer conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock(hashtextextended($1, 0))`, lock)
+
+	j, err := s.load(ctx, name)
+	if err != nil {
+		return err
+	}
+	switch j.status {
+	case JobDone:
+		return nil
+	case JobPaused:
+		return fmt.Errorf("migration job %s: %w", name, ErrJobPaused)
+	case JobFailed:
+		return fmt.Errorf("migration job %s failed (Resume retries its failed units)", name)
+	}
+	if _, err := s.pool.Exec(ctx, `UPDATE migration_units SET state = $2, updated_at = now() WHERE job = $1 AND state = ANY($3)`,
+		name, string(UnitPending), []string{string(UnitCopying), string(UnitVerifying)}); err != nil {
+		return fmt.Errorf("migration job %s: %w", name, err)
+	}
+
+	work, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var paused atomic.Bool
+	go func() {
+		t := time.NewTicker(s.opts.Poll)
+		defer t.Stop()
+		for {
+			select {
+			case <-work.Done():
+				return
+			case <-t.C:
+				var status string
+				err := s.pool.QueryRow(work, `SELECT status FROM migration_jobs WHERE name = $1`, name).Scan(&status)
+				if err == nil && JobStatus(status) == JobPaused {
+					paused.Store(true)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	rate := 0
+	if j.rate > 0 {
+		rate = max(j.rate/j.concurrency, 1)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for w := 0; w < j.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for work.Err() == nil {
+				u, ok, err := s.claim(work, name)
+				if err == nil && ok {
+					err = s.runUnit(work, j, u, rate)
+				}
+				if err != nil && work.Err() == nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					cancel()
+				}
+				if err != nil || !ok {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	switch {
+	case paused.Load():
+		return fmt.Errorf("migration job %s: %w", name, ErrJobPaused)
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case firstErr != nil:
+		return firstErr
+	}
+
+	var failed int
+	if err := s.pool.QueryRow(ctx, `SELECT count(*) FROM migration_units WHERE job = $1 AND state = $2`, name, string(UnitFailed)).Scan(&failed); err != nil {
+		return fmt.Errorf("migration job %s: %w", name, err)
+	}
+	status := JobDone
+	if failed > 0 {
+		status = JobFailed
+	}
+	if _, err := s.pool.Exec(ctx, `UPDATE migration_jobs SET status = $2, updated_at = now() WHERE name = $1 AND status = $3`,
+		name, string(status), string(JobRunning)); err != nil {
+		return fmt.Errorf("migration job %s: %w", name, err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("migration job %s: %d units failed", name, failed)
+	}
+	return nil
+}
+
+// claim marks the first pending unit of job name copying and returns it; ok is false
+// when none is left.
+func (s *JobStore) claim(ctx context.Context, name string) (u jobUnit, ok bool, err error) {
+	err = s.pool.QueryRow(ctx, `
+	UPDATE migration_units SET state = $2, attempts = attempts + 1, updated_at = now()
+	WHERE job = $1 AND seq = (
+		SELECT seq FROM migration_units WHERE job = $1 AND state = $3
+		ORDER BY seq LIMIT 1 FOR UPDATE SKIP LOCKED
+	)
+	RETURNING seq, hash_from, hash_to, src, dst`, name, string(UnitCopying), string(UnitPending)).
+		Scan(&u.seq, &u.start, &u.end, &u.src, &u.dst)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return u, false, nil
+	}
+	if err != nil {
+		return u, false, fmt.Errorf("migration job %s: claim: %w", name, err)
+	}
+	return u, true, nil
+}
+
+// runUnit moves unit u of j, rate rows per second at most, and records the outcome.
+// It only returns an error if the outcome cannot be recorded. A unit interrupted by
+// ctx goes back to pending.
+func (s *JobStore) runUnit(ctx context.Context, j *job, u jobUnit, rate int) error {
+	src, dst := j.from.Pool(ShardID(u.src)), j.to.Pool(ShardID(u.dst))
+	if src == nil || dst == nil {
+		return s.setUnit(ctx, j.name, u, UnitFailed, 0, fmt.Errorf("no pool for %s or %s", u.src, u.dst))
+	}
+	r := u.hashRange()
+	where, args := rangeWhere(r, 1)
+	spec := MoveSpec{Table: j.table, Where: where, Args: args, OrderBy: "user_hash, id", BatchSize: j.batch, RowsPerSecond: rate}
+	for attempt := 1; ; attempt++ {
+		st, err := MoveRows(ctx, src, dst, spec)
+		if err == nil {
+			if err = s.setUnit(ctx, j.name, u, UnitVerifying, st.Rows, nil); err != nil {
+				return err
+			}
+			var left int64
+			if left, err = CountRange(ctx, src, j.table, r); err == nil && left > 0 {
+				err = fmt.Errorf("%w: %d rows left on %s", ErrMoveVerify, left, u.src)
+			}
+			if err == nil {
+				return s.setUnit(ctx, j.name, u, UnitDone, 0, nil)
+			}
+			st.Rows = 0 // recorded with the verifying state
+		}
+		if ctx.Err() != nil {
+			return s.setUnit(context.WithoutCancel(ctx), j.name, u, UnitPending, st.Rows, nil)
+		}
+		if !errors.Is(err, ErrMoveVerify) || attempt == s.opts.Attempts {
+			return s.setUnit(ctx, j.name, u, UnitFailed, st.Rows, err)
+		}
+		if err := s.setUnit(ctx, j.name, u, UnitCopying, st.Rows, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// setUnit stores the state of unit u, adds rows to its moved rows and records unitErr.
+func (s *JobStore) setUnit(ctx context.Context, name string, u jobUnit, state UnitState, rows int64, unitErr error) error {
+	var msg *string
+	if unitErr != nil {
+		m := unitErr.Error()
+		msg = &m
+	}
+	_, err := s.pool.Exec(ctx, `
+	UPDATE migration_units SET state = $3, rows = rows + $4, error = $5, updated_at = now()
+	WHERE job = $1 AND seq = $2`, name, u.seq, string(state), rows, msg)
+	if err != nil {
+		return fmt.Errorf("migration job %s: unit %d: %s: %w", name, u.seq, state, err)
+	}
+	return nil
+}
+
+// ringFromJSON rebuilds a ring stored as RingSpec JSON.
+func ringFromJSON(data []byte, resolve PoolResolver) (*ShardRing, error) {
+	var spec RingSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return NewShardRingFromSpec(spec, resolve)
+}
@@ -0,0 +1,357 @@
+package router
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"partitioning/ready/internal/model"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// FeedStreamer is implemented by fan-out routers that can stream a feed.
+type FeedStreamer interface {
+	IterFeed(ctx context.Context, userIDs []int64, q FeedQuery) (*FeedIterator, error)
+}
+
+var (
+	_ FeedStreamer = (*HashRouter)(nil)
+	_ FeedStreamer = (*ConsistentHashRouter)(nil)
+	_ FeedStreamer = (*DirectoryRouter)(nil)
+)
+
+// runHeap is a min-heap of sorted runs keyed by each run's head in feed order.
+type runHeap [][]shardRow
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return feedBefore(h[i][0].post, h[j][0].post) }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.([]shardRow)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergeRuns k-way merges runs that are each already in feed order, keeping at most
+// limit rows. It costs O(n log k) instead of re-sorting everything.
+// A post read from two shards (both copies of a user during a rebalance, see
+// RebalancePhase) is kept once; copies (see samePost) are adjacent in feed order, so
+// the duplicate is recorded in dups of the row before it, also right after the cut.
+// Different posts sharing an ID are both kept.
+func mergeRuns(runs [][]shardRow, limit int) []shardRow {
+	h := make(runHeap, 0, len(runs))
+	total := 0
+	for _, r := range runs {
+		if len(r) > 0 {
+			h = append(h, r)
+			total += len(r)
+		}
+	}
+	if total > limit {
+		total = limit
+	}
+	heap.Init(&h)
+	out := make([]shardRow, 0, total)
+	for h.Len() > 0 {
+		run := h[0]
+		if n := len(out); n > 0 && samePost(out[n-1].post, run[0].post) {
+			out[n-1].dups = append(out[n-1].dups, run[0].shard)
+		} else if n < limit {
+			out = append(out, run[0])
+		} else {
+			break
+		}
+		if len(run) == 1 {
+			heap.Pop(&h)
+			continue
+		}
+		h[0] = run[1:]
+		heap.Fix(&h, 0)
+	}
+	return out
+}
+
+// shardCursor is an open result set on one shard and its current head row.
+type shardCursor struct {
+	t      *shardFetch
+	rows   pgx.Rows
+	head   model.Post
+	closed bool
+	cancel context.CancelFunc // ends the shard's query
+	load   *ShardLoad
+}
+
+// cursorHeap orders open shard cursors by their head row in feed order.
+type cursorHeap []*shardCursor
+
+func (h cursorHeap) Len() int           { return len(h) }
+func (h cursorHeap) Less(i, j int) bool { return feedBefore(h[i].head, h[j].head) }
+func (h cursorHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x any)        { *h = append(*h, x.(*shardCursor)) }
+func (h *cursorHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// FeedIterator streams a feed merged from per-shard pgx.Rows cursors with a min-heap.
+// Rows come out in feed order as soon as every shard has produced its first row;
+// nothing is materialized or sorted, and once the limit is reached all shard
+// cursors are closed, so no more rows are read.
+//
+// Use it like pgx.Rows:
+//
+//	it, err := r.IterFeed(ctx, userIDs, q)
+//	if err != nil { ... }
+//	defer it.Close()
+//	for it.Next() {
+//		p := it.Post()
+//	}
+//	err = it.Err()
+//
+// With FanoutOptions.AllowPartial a failing shard is dropped from the merge instead of
+// ending it, and Err returns a *PartialResultError once iteration is done.
+// FanoutOptions.ShardTimeout bounds the wait for each shard's first row, and Load
+// counts a shard's query until its cursor is closed. Hedging needs whole answers to
+// race, so a router with FanoutOptions.Hedge set returns ErrHedgedStream.
+type FeedIterator struct {
+	h       cursorHeap
+	cancel  context.CancelFunc
+	targets []*shardFetch
+	partial bool
+	limit   int
+	emitted int
+	cur     model.Post
+	err     error
+	prev    *pageCursor
+	last    map[string]postKey // last emitted position per shard
+}
+
+// ErrHedgedStream is returned by IterFeed on a router with a hedge policy: a hedged
+// read races whole answers from two pools, which a streaming merge never has.
+var ErrHedgedStream = errors.New("hedged reads cannot be streamed")
+
+// openIterator starts one query per target concurrently and waits for each shard's
+// first row, at most until the shard's deadline (see shardDeadline). Every shard is
+// asked for the full limit: with a streaming merge the extra rows are simply never
+// read. Unless opts.AllowPartial is set, the first failing shard cancels the others
+// and the error is returned.
+func openIterator(ctx context.Context, table string, targets []*shardFetch, fq FeedQuery, prev *pageCursor, opts FanoutOptions) (*FeedIterator, error) {
+	if opts.Hedge.enabled() {
+		return nil, ErrHedgedStream
+	}
+	partial := opts.AllowPartial
+	ctx, cancel := context.WithCancel(ctx)
+	it := &FeedIterator{
+		cancel:  cancel,
+		targets: targets,
+		partial: partial,
+		limit:   fq.Limit,
+		prev:    prev,
+		last:    make(map[string]postKey),
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *shardFetch) {
+			defer wg.Done()
+			qctx, qcancel := context.WithCancel(ctx)
+			c := &shardCursor{t: t, cancel: qcancel, load: opts.Load}
+			sql, args := feedSQL(table, t.userIDs, fq, t.after)
+			t.replica.begin()
+			opts.Load.begin(t.shard)
+			// The deadline only bounds the first row: a streaming shard keeps its
+			// cursor for as long as the caller reads.
+			var timer *time.Timer
+			if deadline, ok := shardDeadline(ctx, opts.ShardTimeout); ok {
+				timer = time.AfterFunc(time.Until(deadline), qcancel)
+			}
+			rows, err := t.pool.Query(qctx, sql, args...)
+			ok := false
+			if err == nil {
+				c.rows = rows
+				ok, err = c.advance()
+			}
+			if timer != nil && !timer.Stop() && ctx.Err() == nil {
+				ok, err = false, fmt.Errorf("first row: %w", context.DeadlineExceeded)
+			}
+			if err != nil || !ok {
+				c.close()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				err = fmt.Errorf("shard %d: %w", t.shard, err)
+				t.err, t.state = err, classifyShardErr(err)
+				if firstErr == nil {
+					firstErr = err
+					if !partial {
+						cancel()
+					}
+				}
+				return
+			}
+			t.state = ShardOK
+			if ok {
+				it.h = append(it.h, c)
+			}
+		}(t)
+	}
+	wg.Wait()
+	if firstErr != nil && !partial {
+		it.Close()
+		return nil, firstErr
+	}
+	heap.Init(&it.h)
+	return it, nil
+}
+
+// advance reads the next row into head. It closes the rows when the shard is drained.
+func (c *shardCursor) advance() (bool, error) {
+	if c.rows.Next() {
+		var p model.Post
+		if err := c.rows.Scan(&p.ID, &p.UserID, &p.CreatedAt, &p.Content); err != nil {
+			c.close()
+			return false, fmt.Errorf("scan: %w", err)
+		}
+		c.head = p
+		return true, nil
+	}
+	c.close()
+	return false, c.rows.Err()
+}
+
+// close closes the rows and ends the shard's in-flight query. It is idempotent.
+func (c *shardCursor) close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.rows != nil {
+		c.rows.Close()
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.t.replica.end()
+	c.load.end(c.t.shard)
+}
+
+// Next advances to the next post in feed order. It returns false when the limit is
+// reached, all shards are drained, or an error occurred (see Err).
+func (it *FeedIterator) Next() bool {
+	if it.err != nil || it.emitted >= it.limit || it.h.Len() == 0 {
+		it.Close()
+		return false
+	}
+	it.cur = it.h[0].head
+	it.emitted++
+	// Consume every copy of the post: during a rebalance a user is read from both
+	// its old and its new shard (see RebalancePhase).
+	for it.err == nil && it.h.Len() > 0 && samePost(it.h[0].head, it.cur) {
+		it.step()
+	}
+	if it.emitted >= it.limit {
+		// Caller has enough: stop reading from the remaining shards.
+		it.Close()
+	}
+	return true
+}
+
+// step records the head of the first cursor as returned and advances that cursor.
+func (it *FeedIterator) step() {
+	c := it.h[0]
+	it.last[string(c.t.id)] = keyOf(c.head)
+	ok, err := c.advance()
+	switch {
+	case err != nil:
+		heap.Pop(&it.h)
+		err = fmt.Errorf("shard %d: %w", c.t.shard, err)
+		c.t.err, c.t.state = err, classifyShardErr(err)
+		if !it.partial {
+			it.err = err
+		}
+	case ok:
+		heap.Fix(&it.h, 0)
+	default:
+		heap.Pop(&it.h)
+	}
+}
+
+// Post returns the current post.
+func (it *FeedIterator) Post() model.Post {
+	return it.cur
+}
+
+// Err returns the first error met while reading. In partial mode it returns a
+// *PartialResultError if any shard failed.
+func (it *FeedIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.partial && it.anyFailed() {
+		return &PartialResultError{Shards: it.Shards()}
+	}
+	return nil
+}
+
+// Shards reports each shard's part in the read so far.
+func (it *FeedIterator) Shards() []ShardStatus {
+	statuses := make([]ShardStatus, len(it.targets))
+	for i, t := range it.targets {
+		statuses[i] = t.status()
+	}
+	return statuses
+}
+
+func (it *FeedIterator) anyFailed() bool {
+	for _, t := range it.targets {
+		if t.failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close releases all open shard cursors. It is safe to call more than once.
+func (it *FeedIterator) Close() {
+	for _, c := range it.h {
+		c.close()
+	}
+	it.h = nil
+	it.cancel()
+}
+
+// PageToken returns a token resuming after the last post returned by Next, or ""
+// if the feed ended before the limit was reached and no shard failed.
+func (it *FeedIterator) PageToken() string {
+	if it.emitted == 0 || (it.emitted < it.limit && !it.anyFailed()) {
+		return ""
+	}
+	next := pageCursor{Last: keyOf(it.cur), Shards: make(map[string]postKey)}
+	if it.prev != nil {
+		for s, k := range it.prev.Shards {
+			next.Shards[s] = k
+		}
+	}
+	for _, t := range it.targets {
+		if _, ok := next.Shards[string(t.id)]; t.failed() && !ok {
+			next.Shards[string(t.id)] = postKey{}
+		}
+	}
+	for s, k := range it.last {
+		next.Shards[s] = k
+	}
+	return next.encode()
+}
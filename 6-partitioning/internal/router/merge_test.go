@@ -0,0 +1,163 @@
+package router
+
+import (
+	"container/heap"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"partitioning/ready/internal/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeRows serves posts as a feed query result (id, user_id, created_at, content).
+type fakeRows struct {
+	posts []model.Post
+	i     int
+}
+
+func (r *fakeRows) Close()                                       {}
+func (r *fakeRows) Err() error                                   { return nil }
+func (r *fakeRows) CommandTag() pgconn.CommandTag                { return pgconn.CommandTag{} }
+func (r *fakeRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *fakeRows) Values() ([]any, error)                       { return nil, nil }
+func (r *fakeRows) RawValues() [][]byte                          { return nil }
+func (r *fakeRows) Conn() *pgx.Conn                              { return nil }
+
+func (r *fakeRows) Next() bool {
+	r.i++
+	return r.i <= len(r.posts)
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	p := r.posts[r.i-1]
+	*dest[0].(*int64), *dest[1].(*int64) = p.ID, p.UserID
+	*dest[2].(*time.Time), *dest[3].(*string) = p.CreatedAt, p.Content
+	return nil
+}
+
+var mergeT0 = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// post returns post id of user, min minutes before mergeT0.
+func post(id, user int64, min int) model.Post {
+	return model.Post{ID: id, UserID: user, CreatedAt: mergeT0.Add(-time.Duration(min) * time.Minute)}
+}
+
+// mergeCase lists per-shard runs in feed order and the expected merge.
+type mergeCase struct {
+	name  string
+	runs  [][]model.Post
+	limit int
+	want  []model.Post
+	// copies lists, by post ID and author, the shards a post was merged from when it
+	// was read more than once (mergeRuns only).
+	copies map[[2]int64][]int
+}
+
+var mergeCases = []mergeCase{
+	{
+		name:  "disjoint shards",
+		runs:  [][]model.Post{{post(5, 1, 0), post(3, 1, 2)}, {post(4, 2, 1), post(2, 2, 3)}},
+		limit: 10,
+		want:  []model.Post{post(5, 1, 0), post(4, 2, 1), post(3, 1, 2), post(2, 2, 3)},
+	},
+	{
+		name:   "copy on two shards kept once",
+		runs:   [][]model.Post{{post(5, 1, 0), post(3, 1, 2)}, {post(5, 1, 0), post(4, 2, 1)}},
+		limit:  10,
+		want:   []model.Post{post(5, 1, 0), post(4, 2, 1), post(3, 1, 2)},
+		copies: map[[2]int64][]int{{5, 1}: {0, 1}},
+	},
+	{
+		name:  "same ID, different authors",
+		runs:  [][]model.Post{{post(7, 1, 0)}, {post(7, 2, 0)}, {post(7, 3, 0)}},
+		limit: 10,
+		want:  []model.Post{post(7, 3, 0), post(7, 2, 0), post(7, 1, 0)},
+	},
+	{
+		name:   "copies across an ID shared by another author",
+		runs:   [][]model.Post{{post(7, 2, 0), post(7, 1, 0)}, {post(7, 2, 0)}, {post(7, 1, 0)}},
+		limit:  10,
+		want:   []model.Post{post(7, 2, 0), post(7, 1, 0)},
+		copies: map[[2]int64][]int{{7, 2}: {0, 1}, {7, 1}: {0, 2}},
+	},
+	{
+		name:   "copy right after the cut",
+		runs:   [][]model.Post{{post(5, 1, 0), post(3, 1, 2)}, {post(5, 1, 0)}},
+		limit:  1,
+		want:   []model.Post{post(5, 1, 0)},
+		copies: map[[2]int64][]int{{5, 1}: {0, 1}},
+	},
+}
+
+func TestMergeRuns(t *testing.T) {
+	for _, tt := range mergeCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs [][]shardRow
+			for shard, posts := range tt.runs {
+				f := &shardFetch{shard: shard, id: shardIDAt(nil, shard)}
+				var run []shardRow
+				for _, p := range posts {
+					run = append(run, shardRow{post: p, shard: f})
+				}
+				runs = append(runs, run)
+			}
+			var got []model.Post
+			copies := map[[2]int64][]int{}
+			for _, r := range mergeRuns(runs, tt.limit) {
+				got = append(got, r.post)
+				if len(r.dups) == 0 {
+					continue
+				}
+				// Which copy is kept depends on the heap; the set of shards does not.
+				shards := []int{r.shard.shard}
+				for _, d := range r.dups {
+					shards = append(shards, d.shard)
+				}
+				sort.Ints(shards)
+				copies[[2]int64{r.post.ID, r.post.UserID}] = shards
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged %v, want %v", got, tt.want)
+			}
+			want := tt.copies
+			if want == nil {
+				want = map[[2]int64][]int{}
+			}
+			if !reflect.DeepEqual(copies, want) {
+				t.Errorf("copies %v, want %v", copies, want)
+			}
+		})
+	}
+}
+
+func TestFeedIteratorDedup(t *testing.T) {
+	for _, tt := range mergeCases {
+		t.Run(tt.name, func(t *testing.T) {
+			it := &FeedIterator{cancel: func() {}, limit: tt.limit, last: map[string]postKey{}}
+			for shard, posts := range tt.runs {
+				f := &shardFetch{shard: shard, id: shardIDAt(nil, shard)}
+				it.targets = append(it.targets, f)
+				c := &shardCursor{t: f, rows: &fakeRows{posts: posts}}
+				if ok, err := c.advance(); err != nil || !ok {
+					t.Fatalf("shard %d: %v, %v", shard, ok, err)
+				}
+				it.h = append(it.h, c)
+			}
+			heap.Init(&it.h)
+			var got []model.Post
+			for it.Next() {
+				got = append(got, it.Post())
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("streamed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// moveColumns are the post columns copied between shards, in COPY order.
+var moveColumns = []string{"id", "user_id", "created_at", "content", "user_hash"}
+
+// MoveSpec selects the rows MoveRows moves.
+type MoveSpec struct {
+	// Table is the sharded table on both pools, e.g. posts_hash.
+	Table string
+	// Where selects the rows on the source, with Args as $1..$n.
+	Where string
+	Args  []any
+	// OrderBy is the batch order (default: id); match an index on Where's columns.
+	OrderBy string
+	// BatchSize is the number of rows per batch (default 1000).
+	BatchSize int
+	// Keep copies the rows without deleting them from the source, for a source that
+	// keeps serving reads (see Rebalancer). Batches then follow id order.
+	Keep bool
+	// RowsPerSecond caps the rate at which rows are read from the source, to spare a
+	// shard that is serving traffic (0: no limit).
+	RowsPerSecond int
+}
+
+// MoveStats reports what MoveRows moved.
+type MoveStats struct {
+	Rows     int64
+	Batches  int
+	Duration time.Duration
+}
+
+// ErrMoveVerify is wrapped by MoveRows when the destination does not hold exactly the
+// rows read from the source; the source rows of that batch are then left in place.
+var ErrMoveVerify = errors.New("moved rows do not match the source")
+
+// MoveRows moves the rows selected by spec from src to dst, which may be different
+// databases. Each batch is streamed from src and written to dst with COPY (through a
+// temporary table, so rows already on dst with the same id are kept instead of failing
+// the COPY). Then the row count and a checksum of every column are computed on both
+// sides for the batch's IDs, and only if they match is the batch deleted from src.
+// An interrupted move can be run again: it picks up the rows still on src.
+//
+// Rows deleted from src while their batch was being copied are deleted from dst too,
+// and the batch is verified on the rows src still has, so deletes sent to both pools
+// during the move (see RebalancePhase) do not bring a post back.
+func MoveRows(ctx context.Context, src, dst *pgxpool.Pool, spec MoveSpec) (MoveStats, error) {
+	start := time.Now()
+	var st MoveStats
+	if src == dst {
+		return st, fmt.Errorf("move %s: source and destination are the same pool", spec.Table)
+	}
+	if spec.BatchSize <= 0 {
+		spec.BatchSize = 1000
+	}
+	if spec.OrderBy == "" {
+		spec.OrderBy = "id"
+	}
+	where, args := spec.Where, append([]any(nil), spec.Args...)
+	var after int64 = math.MinInt64 // with Keep: the last id copied
+	if spec.Keep {
+		// Copied rows stay on src, so walk the rows in id order instead.
+		where, spec.OrderBy = fmt.Sprintf("(%s) AND id > $%d", where, len(args)+1), "id"
+		args = append(args, after)
+	}
+	selectSQL := fmt.Sprintf(`SELECT id, user_id, created_at, content, user_hash FROM %s WHERE %s ORDER BY %s LIMIT $%d`,
+		spec.Table, where, spec.OrderBy, len(args)+1)
+	for {
+		if spec.Keep {
+			args[len(args)-1] = after
+		}
+		rows, err := src.Query(ctx, selectSQL, append(args, spec.BatchSize)...)
+		if err != nil {
+			return st, fmt.Errorf("read %s: %w", spec.Table, err)
+		}
+		batch, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) ([]any, error) {
+			var id, userID int64
+			var createdAt time.Time
+			var content string
+			var userHash *int64
+			err := row.Scan(&id, &userID, &createdAt, &content, &userHash)
+			return []any{id, userID, createdAt, content, userHash}, err
+		})
+		if err != nil {
+			return st, fmt.Errorf("read %s: %w", spec.Table, err)
+		}
+		if len(batch) == 0 {
+			st.Duration = time.Since(start)
+			return st, nil
+		}
+		ids := make([]int64, len(batch))
+		for i, r := range batch {
+			ids[i] = r[0].(int64)
+		}
+		if err := copyRows(ctx, dst, spec.Table, batch); err != nil {
+			return st, err
+		}
+		kept, err := dropDeleted(ctx, src, dst, spec.Table, ids)
+		if err != nil {
+			return st, err
+		}
+		if err := verifyMoved(ctx, src, dst, spec.Table, kept); err != nil {
+			return st, err
+		}
+		st.Batches++
+		if spec.Keep {
+			after = ids[len(ids)-1]
+			st.Rows += int64(len(kept))
+		} else {
+			tag, err := src.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = ANY($1)`, spec.Table), kept)
+			if err != nil {
+				return st, fmt.Errorf("delete moved %s rows: %w", spec.Table, err)
+			}
+			st.Rows += tag.RowsAffected()
+		}
+		if err := throttle(ctx, start, st.Rows, spec.RowsPerSecond); err != nil {
+			return st, err
+		}
+	}
+}
+
+// throttle sleeps until rows rows take at least 1/rps seconds each since start.
+func throttle(ctx context.Context, start time.Time, rows int64, rps int) error {
+	if rps <= 0 {
+		return nil
+	}
+	wait := time.Duration(float64(rows)/float64(rps)*float64(time.Second)) - time.Since(start)
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// MoveUser moves all posts of userID from src to dst (see MoveRows).
+func MoveUser(ctx context.Context, src, dst *pgxpool.Pool, table string, userID int64, batchSize int) (MoveStats, error) {
+	return MoveRows(ctx, src, dst, MoveSpec{Table: table, Where: "user_id = $1", Args: []any{userID}, BatchSize: batchSize})
+}
+
+// moveStage is the temporary table copyRows stages rows in. Its name is fixed and
+// unqualified: temporary tables live in their own schema, so a qualified table such as
+// public.posts cannot prefix it, and ON COMMIT DROP keeps one per transaction.
+const moveStage = "posts_move_stage"
+
+// copyRows writes rows to table on dst with COPY into a temporary table and one
+// INSERT ... ON CONFLICT (id) DO NOTHING, in a single transaction.
+func copyRows(ctx context.Context, dst *pgxpool.Pool, table string, rows [][]any) error {
+	tx, err := dst.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("copy %s: %w", table, err)
+	}
+	defer tx.Rollback(ctx)
+	stage := pgx.Identifier{moveStage}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP`, stage.Sanitize(), table)); err != nil {
+		return fmt.Errorf("copy %s: %w", table, err)
+	}
+	if _, err := tx.CopyFrom(ctx, stage, moveColumns, pgx.CopyFromRows(rows)); err != nil {
+		return fmt.Errorf("copy %s: %w", table, err)
+	}
+	cols := "id, user_id, created_at, content, user_hash"
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (id) DO NOTHING`, table, cols, cols, stage.Sanitize())); err != nil {
+		return fmt.Errorf("copy %s: %w", table, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("copy %s: %w", table, err)
+	}
+	return nil
+}
+
+// dropDeleted deletes from dst the rows of ids that are no longer on src, so a copy
+// does not bring back a post deleted while it was in flight, and returns the ids
+// still on src.
+func dropDeleted(ctx context.Context, src, dst *pgxpool.Pool, table string, ids []int64) ([]int64, error) {
+	rows, err := src.Query(ctx, fmt.Sprintf(`SELECT id FROM %s WHERE id = ANY($1)`, table), ids)
+	if err != nil {
+		return nil, fmt.Errorf("recheck %s: %w", table, err)
+	}
+	kept, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("recheck %s: %w", table, err)
+	}
+	if len(kept) == len(ids) {
+		return kept, nil
+	}
+	if _, err := dst.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = ANY($1) AND NOT id = ANY($2)`, table), ids, kept); err != nil {
+		return nil, fmt.Errorf("drop deleted %s rows: %w", table, err)
+	}
+	return kept, nil
+}
+
+// verifyMoved compares the row count and checksum of ids on src and dst.
+func verifyMoved(ctx context.Context, src, dst *pgxpool.Pool, table string, ids []int64) error {
+	want, err := rowsChecksum(ctx, src, table, "id = ANY($1)", ids)
+	if err != nil {
+		return err
+	}
+	got, err := rowsChecksum(ctx, dst, table, "id = ANY($1)", ids)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%s: %w: source %s, destination %s", table, ErrMoveVerify, want, got)
+	}
+	return nil
+}
+
+// rowsChecksum returns "count/checksum" of the rows matching where: the sum of a 64-bit
+// hash of every row's columns, which does not depend on row order or physical layout.
+func rowsChecksum(ctx context.Context, pool *pgxpool.Pool, table, where string, args ...any) (string, error) {
+	var sum string
+	err := pool.QueryRow(ctx, fmt.Sprintf(`
+	SELECT count(*) || '/' || coalesce(sum(hashtextextended(
+		concat_ws('|', id, user_id, created_at, content, user_hash), 0)::numeric), 0)
+	FROM %s WHERE %s`, table, where), args...).Scan(&sum)
+	if err != nil {
+		return "", fmt.Errorf("checksum %s: %w", table, err)
+	}
+	return sum, nil
+}
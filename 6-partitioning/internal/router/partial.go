@@ -0,0 +1,70 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ShardState is the outcome of one shard's part of a fan-out read.
+type ShardState string
+
+const (
+	ShardOK      ShardState = "ok"
+	ShardError   ShardState = "error"
+	ShardTimeout ShardState = "timeout"
+	// ShardSkipped means the shard query was cancelled or never ran because the read
+	// was abandoned first (another shard failed hard, or the caller gave up).
+	ShardSkipped ShardState = "skipped"
+)
+
+// ShardStatus reports how one shard took part in a fan-out read.
+type ShardStatus struct {
+	Shard int
+	State ShardState
+	Err   error
+	// UserIDs are the users routed to this shard; if State is not ShardOK,
+	// their posts are missing from the result.
+	UserIDs []int64
+}
+
+// PartialResultError is returned together with the posts of the healthy shards
+// when a read in partial mode (FanoutOptions.AllowPartial) could not reach every shard.
+type PartialResultError struct {
+	Shards []ShardStatus // every shard of the read, including the healthy ones
+}
+
+func (e *PartialResultError) Error() string {
+	var parts []string
+	for _, s := range e.Failed() {
+		parts = append(parts, fmt.Sprintf("shard %d %s (%d users): %v", s.Shard, s.State, len(s.UserIDs), s.Err))
+	}
+	return "partial feed: " + strings.Join(parts, "; ")
+}
+
+// Failed returns the statuses of shards whose posts are missing.
+func (e *PartialResultError) Failed() []ShardStatus {
+	var failed []ShardStatus
+	for _, s := range e.Shards {
+		if s.State != ShardOK {
+			failed = append(failed, s)
+		}
+	}
+	return failed
+}
+
+// classifyShardErr maps a shard query error to its state.
+// pgconn reports both cancellation and deadlines as timeouts, so check cancellation first.
+func classifyShardErr(err error) ShardState {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ShardSkipped
+	case errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err):
+		return ShardTimeout
+	default:
+		return ShardError
+	}
+}
@@ -0,0 +1,212 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Partitioner is the owner-lookup contract shared by the consistent hashing schemes:
+// it maps a 64-bit key hash (see HashUser) to a shard index.
+type Partitioner interface {
+	Owner(key uint64) int
+}
+
+var (
+	_ Partitioner = (*Ring)(nil)
+	_ Partitioner = (*Rendezvous)(nil)
+	_ Partitioner = (*JumpHash)(nil)
+	_ Partitioner = (*BoundedLoad)(nil)
+)
+
+// Partitioning schemes accepted by NewPartitioner.
+const (
+	SchemeRing       = "ring"
+	SchemeRendezvous = "rendezvous"
+	SchemeJump       = "jump"
+	SchemeBounded    = "bounded"
+)
+
+// Schemes lists the names accepted by NewPartitioner.
+func Schemes() []string {
+	return []string{SchemeRing, SchemeRendezvous, SchemeJump, SchemeBounded}
+}
+
+// NewPartitioner builds the named scheme over shards. weights, if set, holds one
+// positive weight per shard: ring and bounded scale the shard's virtual nodes by it,
+// rendezvous scales its score so it wins a proportional share of keys, and jump
+// rejects weights. vnodes is the ring's replica factor and is ignored by the other
+// schemes.
+func NewPartitioner(scheme string, shards []int, weights []float64, vnodes int) (Partitioner, error) {
+	if weights != nil && len(weights) != len(shards) {
+		return nil, fmt.Errorf("got %d weights for %d shards", len(weights), len(shards))
+	}
+	switch scheme {
+	case "", SchemeRing:
+		return newWeightedRing(shards, weights, vnodes)
+	case SchemeBounded:
+		r, err := newWeightedRing(shards, weights, vnodes)
+		if err != nil {
+			return nil, err
+		}
+		b, err := NewBoundedLoad(r, DefaultBoundedEpsilon)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case SchemeRendezvous:
+		rz, err := NewRendezvous(shards, weights)
+		if err != nil {
+			return nil, err
+		}
+		return rz, nil
+	case SchemeJump:
+		if weights != nil {
+			return nil, fmt.Errorf("jump hash does not support weights")
+		}
+		return NewJumpHash(shards), nil
+	}
+	return nil, fmt.Errorf("unknown partitioner %q (available: %v)", scheme, Schemes())
+}
+
+// newWeightedRing builds a ring over shards, scaling virtual nodes by weights if set.
+func newWeightedRing(shards []int, weights []float64, vnodes int) (*Ring, error) {
+	r := NewRing(vnodes)
+	if weights == nil {
+		r.Build(shards)
+		return r, nil
+	}
+	byShard := make(map[int]float64, len(shards))
+	for i, s := range shards {
+		if err := checkWeight(s, weights[i]); err != nil {
+			return nil, err
+		}
+		byShard[s] = weights[i]
+	}
+	r.BuildWeighted(byShard)
+	return r, nil
+}
+
+// ParseWeights parses a comma-separated list of shard weights, e.g. "1,1,2".
+// An empty string means no weights.
+func ParseWeights(s string) ([]float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	weights := make([]float64, len(parts))
+	for i, p := range parts {
+		w, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("weight %d: %w", i, err)
+		}
+		weights[i] = w
+	}
+	return weights, nil
+}
+
+// checkWeight rejects weights that cannot scale a shard's share of keys.
+func checkWeight(shard int, w float64) error {
+	if w <= 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+		return fmt.Errorf("shard %d: weight must be positive, got %v", shard, w)
+	}
+	return nil
+}
+
+// Rendezvous implements rendezvous (highest random weight) hashing: every shard scores
+// the key and the highest score wins. Adding or removing a shard only moves the keys
+// it wins or held, with no virtual nodes to tune; the price is an O(shards) lookup.
+type Rendezvous struct {
+	shards   []int
+	seeds    []uint64
+	weights  []float64 // nil when all shards weigh the same
+	weighted bool
+}
+
+// NewRendezvous creates a rendezvous partitioner over shard indices. With weights, a
+// shard's expected share of keys is proportional to its weight.
+func NewRendezvous(shards []int, weights []float64) (*Rendezvous, error) {
+	if weights != nil && len(weights) != len(shards) {
+		return nil, fmt.Errorf("got %d weights for %d shards", len(weights), len(shards))
+	}
+	r := &Rendezvous{shards: append([]int(nil), shards...), seeds: make([]uint64, len(shards))}
+	for i, s := range shards {
+		// Same seeding as ring points, so shard identity alone decides its scores.
+		r.seeds[i] = hashUint64((uint64(s) + 1) * 0x9e3779b97f4a7c15)
+	}
+	for i, w := range weights {
+		if err := checkWeight(shards[i], w); err != nil {
+			return nil, err
+		}
+		if w != weights[0] {
+			r.weighted = true
+		}
+	}
+	if r.weighted {
+		r.weights = append([]float64(nil), weights...)
+	}
+	return r, nil
+}
+
+// Owner returns the shard with the highest score for key.
+func (r *Rendezvous) Owner(key uint64) int {
+	if len(r.shards) == 0 {
+		return 0
+	}
+	best := 0
+	if !r.weighted {
+		var top uint64
+		for i, seed := range r.seeds {
+			if h := hashUint64(key ^ seed); i == 0 || h > top {
+				best, top = i, h
+			}
+		}
+		return r.shards[best]
+	}
+	// Weighted HRW: score = -w / ln(u) with u uniform in (0, 1). The highest score wins
+	// with probability w / sum(w), and only keys won by a changed shard move.
+	top := math.Inf(-1)
+	for i, seed := range r.seeds {
+		u := (float64(hashUint64(key^seed)>>11) + 0.5) / (1 << 53)
+		if score := -r.weights[i] / math.Log(u); score > top {
+			best, top = i, score
+		}
+	}
+	return r.shards[best]
+}
+
+// JumpHash implements jump consistent hashing (Lamping & Veach): it maps a key to one of
+// N buckets with no state beyond N. Appending a shard moves only ~1/N of the keys, all of
+// them to the new shard, so it replaces user_id % N. Shards can only be added or removed
+// at the end of the list; removing one in the middle reshuffles the ones after it.
+type JumpHash struct {
+	shards []int
+}
+
+// NewJumpHash creates a jump hash partitioner; bucket i belongs to shards[i].
+func NewJumpHash(shards []int) *JumpHash {
+	return &JumpHash{shards: append([]int(nil), shards...)}
+}
+
+// Owner returns the shard of the key's jump hash bucket.
+func (j *JumpHash) Owner(key uint64) int {
+	if len(j.shards) == 0 {
+		return 0
+	}
+	return j.shards[Jump(key, len(j.shards))]
+}
+
+// Jump returns the bucket of key among buckets (0..buckets-1), or 0 if buckets <= 0.
+func Jump(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	if b < 0 {
+		return 0
+	}
+	return int(b)
+}
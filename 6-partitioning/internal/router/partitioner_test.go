@@ -0,0 +1,58 @@
+package router
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TestJump checks Jump against reference values of the algorithm in Lamping and
+// Veach, "A Fast, Minimal Memory, Consistent Hash Algorithm".
+func TestJump(t *testing.T) {
+	tests := []struct {
+		key     uint64
+		buckets int
+		want    int
+	}{
+		{1, 1, 0},
+		{42, 57, 43},
+		{0xDEAD10CC, 1, 0},
+		{0xDEAD10CC, 666, 361},
+		{256, 1024, 520},
+		{0, -10, 0},
+		{0xDEAD10CC, -666, 0},
+		{0xDEAD10CC, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := Jump(tt.key, tt.buckets); got != tt.want {
+			t.Errorf("Jump(%#x, %d) = %d, want %d", tt.key, tt.buckets, got, tt.want)
+		}
+	}
+}
+
+// TestBoundedLiveLoads checks that a router stops placing posts once its bounded
+// partitioner follows live loads, and resumes with an assigned placement.
+func TestBoundedLiveLoads(t *testing.T) {
+	p, err := NewPartitioner(SchemeBounded, []int{0, 1, 2}, nil, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := p.(*BoundedLoad)
+	r := &ConsistentHashRouter{Shards: make([]*pgxpool.Pool, 3), Partitioner: b}
+	b.AssignUsers([]int64{1, 2, 3})
+	if _, err := r.ShardOf(context.Background(), 1); err != nil {
+		t.Fatalf("assigned placement: %v", err)
+	}
+	b.SetLoads(map[int]float64{0: 5, 1: 0, 2: 1})
+	if !b.LiveLoads() {
+		t.Fatal("LiveLoads is false after SetLoads")
+	}
+	if _, err := r.ShardOf(context.Background(), 1); err == nil {
+		t.Error("router placed a user by live loads")
+	}
+	b.AssignUsers([]int64{1, 2, 3})
+	if _, err := r.ShardOf(context.Background(), 1); err != nil {
+		t.Errorf("placement after AssignUsers: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RebalancePlan is the estimated cost and outcome of moving a sharded table from one
+// ring to another, before any row moves. WritePlanFile stores it so the move can be
+// reviewed and then run from the file (see Rings).
+type RebalancePlan struct {
+	Table string   `json:"table"`
+	From  RingSpec `json:"from"`
+	To    RingSpec `json:"to"`
+	// SamplePercent is the share of each shard's pages read to estimate the counts;
+	// 100 counts every row.
+	SamplePercent float64         `json:"sample_percent"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Moves         []PlannedMove   `json:"moves"`
+	Shards        []ShardEstimate `json:"shards"`
+}
+
+// PlannedMove is a range of From.Diff(To) with the estimated rows and bytes on its
+// source.
+type PlannedMove struct {
+	HashRange
+	From  ShardID `json:"from"`
+	To    ShardID `json:"to"`
+	Rows  int64   `json:"rows"`
+	Bytes int64   `json:"bytes"`
+}
+
+// ShardEstimate is the estimated size of one shard before and after a plan runs.
+// Share and ShareAfter are its fractions of all rows; Keyspace is its fraction of the
+// keyspace on the new ring (0 if it leaves the ring).
+type ShardEstimate struct {
+	ID         ShardID `json:"id"`
+	Rows       int64   `json:"rows"`
+	Bytes      int64   `json:"bytes"`
+	RowsAfter  int64   `json:"rows_after"`
+	BytesAfter int64   `json:"bytes_after"`
+	Share      float64 `json:"share"`
+	ShareAfter float64 `json:"share_after"`
+	Keyspace   float64 `json:"keyspace"`
+	// Unhashed rows have no user_hash and are not moved by range (see BackfillUserHash).
+	Unhashed int64 `json:"unhashed,omitempty"`
+}
+
+// PlanRebalance estimates what moving table from ring from to ring to would move. It
+// samples percent of the pages of every shard on from (TABLESAMPLE SYSTEM, with a
+// fixed seed so the same data gives the same plan; 100 or more reads every row),
+// assigns each sampled row to its range of from.Diff(to) by user_hash and scales the
+// counts up by 100/percent. Bytes are the rows' on-disk size (pg_column_size), without
+// indexes. Both rings need pools for the shards of from.
+func PlanRebalance(ctx context.Context, from, to *ShardRing, table string, percent float64) (*RebalancePlan, error) {
+	if percent <= 0 {
+		return nil, fmt.Errorf("sample percent must be positive, got %v", percent)
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	moves := from.Diff(to)
+	plan := &RebalancePlan{Table: table, From: from.Spec(), To: to.Spec(), SamplePercent: percent, CreatedAt: time.Now().UTC()}
+	for _, m := range moves {
+		plan.Moves = append(plan.Moves, PlannedMove{HashRange: m.HashRange, From: from.ID(m.From), To: to.ID(m.To)})
+	}
+	sampleSQL := fmt.Sprintf(`SELECT user_hash, pg_column_size(t.*) FROM %s AS t`, table)
+	if percent < 100 {
+		sampleSQL += fmt.Sprintf(` TABLESAMPLE SYSTEM (%g) REPEATABLE (0)`, percent)
+	}
+	scale := 100 / percent
+
+	shards := map[ShardID]*ShardEstimate{}
+	estimate := func(id ShardID) *ShardEstimate {
+		if shards[id] == nil {
+			shards[id] = &ShardEstimate{ID: id}
+		}
+		return shards[id]
+	}
+	for _, id := range from.Shards() {
+		slot, _ := from.Slot(id)
+		pool := from.Pool(id)
+		if pool == nil {
+			return nil, fmt.Errorf("plan: shard %s has no pool", id)
+		}
+		rows, err := pool.Query(ctx, sampleSQL)
+		if err != nil {
+			return nil, fmt.Errorf("sample %s on %s: %w", table, id, err)
+		}
+		rowsOut, bytesOut := make([]float64, len(moves)), make([]float64, len(moves))
+		var n, size, unhashed float64
+		var hash *int64
+		var rowSize int64
+		_, err = pgx.ForEachRow(rows, []any{&hash, &rowSize}, func() error {
+			n++
+			size += float64(rowSize)
+			if hash == nil {
+				unhashed++
+				return nil
+			}
+			if i := moveOf(moves, uint64(*hash)^1<<63, slot); i >= 0 { // inverse of UserHashKey
+				rowsOut[i]++
+				bytesOut[i] += float64(rowSize)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("sample %s on %s: %w", table, id, err)
+		}
+		est := estimate(id)
+		est.Rows, est.Bytes, est.Unhashed = int64(n*scale), int64(size*scale), int64(unhashed*scale)
+		for i := range moves {
+			plan.Moves[i].Rows += int64(rowsOut[i] * scale)
+			plan.Moves[i].Bytes += int64(bytesOut[i] * scale)
+		}
+	}
+
+	for _, id := range to.Shards() {
+		estimate(id)
+	}
+	for _, est := range shards {
+		est.RowsAfter, est.BytesAfter = est.Rows, est.Bytes
+	}
+	for _, m := range plan.Moves {
+		src, dst := estimate(m.From), estimate(m.To)
+		src.RowsAfter -= m.Rows
+		src.BytesAfter -= m.Bytes
+		dst.RowsAfter += m.Rows
+		dst.BytesAfter += m.Bytes
+	}
+	var total int64
+	for _, est := range shards {
+		total += est.Rows
+	}
+	for _, sh := range to.Shares() {
+		estimate(to.ID(sh.Shard)).Keyspace = sh.Actual
+	}
+	for _, est := range shards {
+		if total > 0 {
+			est.Share = float64(est.Rows) / float64(total)
+			est.ShareAfter = float64(est.RowsAfter) / float64(total)
+		}
+		plan.Shards = append(plan.Shards, *est)
+	}
+	sort.Slice(plan.Shards, func(i, j int) bool { return plan.Shards[i].ID < plan.Shards[j].ID })
+	return plan, nil
+}
+
+// moveOf returns the index of the move in moves (in key order) that takes key away
+// from slot, or -1 if key stays or is not on slot: a misplaced row is not moved.
+func moveOf(moves []RangeMove, key uint64, slot int) int {
+	i := sort.Search(len(moves), func(i int) bool { return moves[i].End == 0 || moves[i].End > key })
+	if i < len(moves) && moves[i].Contains(key) && moves[i].From == slot {
+		return i
+	}
+	return -1
+}
+
+// Moved returns the estimated rows and bytes of all moves.
+func (p *RebalancePlan) Moved() (rows, bytes int64) {
+	for _, m := range p.Moves {
+		rows += m.Rows
+		bytes += m.Bytes
+	}
+	return rows, bytes
+}
+
+// Rings rebuilds the rings of the plan with pools from resolve. It fails if the moves
+// are not those of From.Diff(To), e.g. because the file was edited, since a partial
+// plan would leave rows outside their owner's ranges.
+func (p *RebalancePlan) Rings(resolve PoolResolver) (from, to *ShardRing, err error) {
+	if from, err = NewShardRingFromSpec(p.From, resolve); err != nil {
+		return nil, nil, fmt.Errorf("plan from: %w", err)
+	}
+	if to, err = NewShardRingFromSpec(p.To, resolve); err != nil {
+		return nil, nil, fmt.Errorf("plan to: %w", err)
+	}
+	moves := from.Diff(to)
+	if len(moves) != len(p.Moves) {
+		return nil, nil, fmt.Errorf("plan lists %d moves, its rings differ in %d ranges", len(p.Moves), len(moves))
+	}
+	for i, m := range moves {
+		pm := p.Moves[i]
+		if pm.HashRange != m.HashRange || pm.From != from.ID(m.From) || pm.To != to.ID(m.To) {
+			return nil, nil, fmt.Errorf("plan move %d [%d, %d) %s -> %s does not match its rings", i, pm.Start, pm.End, pm.From, pm.To)
+		}
+	}
+	return from, to, nil
+}
+
+// WritePlanFile stores p at path as indented JSON. Like WriteTopologyFile it writes a
+// temporary file and renames it, so a crash never leaves a truncated plan.
+func WritePlanFile(path string, p *RebalancePlan) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// ReadPlanFile loads a plan written by WritePlanFile.
+func ReadPlanFile(path string) (*RebalancePlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p RebalancePlan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("plan %s: %w", path, err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,122 @@
+package router
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// planRings returns ring(0..2) and the result of change applied to it.
+func planRings(t *testing.T, change func(*ShardRing) (*ShardRing, error)) (from, to *ShardRing) {
+	t.Helper()
+	from = NewShardRing(50)
+	var err error
+	for _, id := range []ShardID{"shard_0", "shard_1", "shard_2"} {
+		if from, err = from.Add(id, nil, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if to, err = change(from); err != nil {
+		t.Fatal(err)
+	}
+	return from, to
+}
+
+var planChanges = []struct {
+	name   string
+	change func(*ShardRing) (*ShardRing, error)
+}{
+	{"add", func(r *ShardRing) (*ShardRing, error) { return r.Add("shard_3", nil, 1) }},
+	{"remove", func(r *ShardRing) (*ShardRing, error) { return r.Remove("shard_1") }},
+	{"split", func(r *ShardRing) (*ShardRing, error) { return r.Split("shard_2", "shard_3", nil, 0.5) }},
+}
+
+func TestMoveOf(t *testing.T) {
+	for _, tt := range planChanges {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := planRings(t, tt.change)
+			moves := from.Diff(to)
+			keys := []uint64{0, 1<<64 - 1}
+			for _, m := range moves {
+				keys = append(keys, m.Start-1, m.Start, m.End-1, m.End)
+			}
+			for i := uint64(0); i < 1000; i++ {
+				keys = append(keys, hashUint64(i))
+			}
+			for _, key := range keys {
+				src, dst := from.Owner(key), to.Owner(key)
+				i := moveOf(moves, key, src)
+				switch {
+				case from.ID(src) == to.ID(dst) && i >= 0:
+					t.Errorf("key %d stays on %s but is in move %d", key, from.ID(src), i)
+				case from.ID(src) != to.ID(dst) && i < 0:
+					t.Errorf("key %d goes %s -> %s but is in no move", key, from.ID(src), to.ID(dst))
+				case i >= 0 && (moves[i].From != src || moves[i].To != dst):
+					t.Errorf("key %d goes %d -> %d, move %d says %d -> %d", key, src, dst, i, moves[i].From, moves[i].To)
+				}
+				// A row found on another shard than its owner is misplaced and not moved.
+				for slot := range from.Shards() {
+					if slot != src && moveOf(moves, key, slot) >= 0 {
+						t.Errorf("key %d on slot %d is counted, its owner is %d", key, slot, src)
+					}
+				}
+			}
+		})
+	}
+}
+
+// testPlan is the plan PlanRebalance would return for from and to, without counts.
+func testPlan(from, to *ShardRing) *RebalancePlan {
+	p := &RebalancePlan{Table: "posts_hash", From: from.Spec(), To: to.Spec(), SamplePercent: 100}
+	for _, m := range from.Diff(to) {
+		p.Moves = append(p.Moves, PlannedMove{HashRange: m.HashRange, From: from.ID(m.From), To: to.ID(m.To)})
+	}
+	return p
+}
+
+func TestRebalancePlanRings(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*RebalancePlan)
+		ok   bool
+	}{
+		{"as planned", func(*RebalancePlan) {}, true},
+		{"move dropped", func(p *RebalancePlan) { p.Moves = p.Moves[1:] }, false},
+		{"range edited", func(p *RebalancePlan) { p.Moves[0].End-- }, false},
+		{"target edited", func(p *RebalancePlan) { p.Moves[0].To = p.Moves[0].From }, false},
+		{"source edited", func(p *RebalancePlan) { p.Moves[0].From = "shard_9" }, false},
+		{"ring edited", func(p *RebalancePlan) { p.To.Shards[0].Weight *= 2 }, false},
+	}
+	for _, change := range planChanges {
+		for _, tt := range tests {
+			t.Run(change.name+"/"+tt.name, func(t *testing.T) {
+				from, to := planRings(t, change.change)
+				p := testPlan(from, to)
+				tt.edit(p)
+				path := filepath.Join(t.TempDir(), "plan.json")
+				if err := WritePlanFile(path, p); err != nil {
+					t.Fatal(err)
+				}
+				p, err := ReadPlanFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotFrom, gotTo, err := p.Rings(nil)
+				if !tt.ok {
+					if err == nil {
+						t.Error("Rings accepted an edited plan")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if gotFrom.Version() != from.Version() || gotTo.Version() != to.Version() {
+					t.Errorf("epochs %d -> %d, want %d -> %d", gotFrom.Version(), gotTo.Version(), from.Version(), to.Version())
+				}
+				if n, want := len(gotFrom.Diff(gotTo)), len(from.Diff(to)); n != want {
+					t.Errorf("rebuilt rings differ in %d ranges, want %d", n, want)
+				}
+			})
+		}
+	}
+}
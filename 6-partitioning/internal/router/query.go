@@ -0,0 +1,160 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"partitioning/ready/internal/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FeedQuery describes one feed read. Every router applies it with the same semantics:
+// - Since is inclusive (created_at >= Since); zero means no lower bound.
+// - Until is exclusive (created_at < Until); zero means no upper bound.
+// - Limit caps the number of rows returned and must be positive.
+// - PageToken, if set, resumes after the page that returned it (see FeedPage).
+// Results are always ordered by created_at DESC, id DESC (ties broken by the newer ID).
+type FeedQuery struct {
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	PageToken string
+}
+
+// Validate reports whether the query can be executed.
+func (q FeedQuery) Validate() error {
+	if q.Limit <= 0 {
+		return fmt.Errorf("limit must be positive, got %d", q.Limit)
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Since.Before(q.Until) {
+		return fmt.Errorf("empty window: since %s is not before until %s", q.Since, q.Until)
+	}
+	return nil
+}
+
+// MonthWindow returns the calendar month containing t as [start, end).
+// Month-aligned windows let Postgres prune posts_range down to a single partition.
+func MonthWindow(t time.Time) (time.Time, time.Time) {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// QueryFromContext builds the FeedQuery used by GetFeed.
+// If the context carries a cutoff under CtxCutoffKey, the window is [cutoff, now];
+// otherwise it defaults to the current calendar month for every router,
+// so different modes always compare the same query.
+func QueryFromContext(ctx context.Context, limit int) FeedQuery {
+	if cutoff, ok := GetCutoff(ctx); ok {
+		return FeedQuery{Since: cutoff, Limit: limit}
+	}
+	since, until := MonthWindow(time.Now())
+	return FeedQuery{Since: since, Until: until, Limit: limit}
+}
+
+// postKey is the position of a post in feed order.
+type postKey struct {
+	CreatedAt time.Time `json:"t"`
+	ID        int64     `json:"id"`
+}
+
+func keyOf(p model.Post) postKey {
+	return postKey{CreatedAt: p.CreatedAt, ID: p.ID}
+}
+
+func (k postKey) equal(o postKey) bool {
+	return k.CreatedAt.Equal(o.CreatedAt) && k.ID == o.ID
+}
+
+// feedBefore reports whether a comes before b in feed order
+// (created_at DESC, id DESC, then user_id DESC so equal IDs on different shards stay ordered).
+func feedBefore(a, b model.Post) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	if a.ID != b.ID {
+		return a.ID > b.ID
+	}
+	return a.UserID > b.UserID
+}
+
+// samePost reports whether a and b are copies of one post: the same ID and author,
+// the key feedBefore orders equal timestamps by, so copies are adjacent in feed order.
+func samePost(a, b model.Post) bool {
+	return a.ID == b.ID && a.UserID == b.UserID
+}
+
+// feedSQL renders the feed statement for table and its arguments.
+// Window predicates are only emitted when set, so the planner sees plain
+// comparisons on created_at and can still prune range partitions.
+// A non-nil after resumes strictly after that position (keyset pagination).
+func feedSQL(table string, userIDs []int64, q FeedQuery, after *postKey) (string, []any) {
+	args := []any{userIDs}
+	where := []string{"user_id = ANY($1)"}
+	if !q.Since.IsZero() {
+		args = append(args, q.Since)
+		where = append(where, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !q.Until.IsZero() {
+		args = append(args, q.Until)
+		where = append(where, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	if after != nil {
+		// The plain created_at bound is redundant with the row comparison, but it is
+		// what lets the planner prune partitions newer than the cursor.
+		args = append(args, after.CreatedAt, after.ID)
+		where = append(where, fmt.Sprintf("created_at <= $%d AND (created_at, id) < ($%d, $%d)", len(args)-1, len(args)-1, len(args)))
+	}
+	args = append(args, q.Limit)
+	sql := fmt.Sprintf(`
+	SELECT id, user_id, created_at, content
+	FROM %s
+	WHERE %s
+	ORDER BY created_at DESC, id DESC
+	LIMIT $%d;`, table, strings.Join(where, " AND "), len(args))
+	return sql, args
+}
+
+// queryTablePage runs q against a single table and builds the next page token.
+// The token's global position is the whole cursor: one table has a single order.
+func queryTablePage(ctx context.Context, pool *pgxpool.Pool, table string, userIDs []int64, q FeedQuery) (FeedPage, error) {
+	cur, err := decodeCursor(q.PageToken)
+	if err != nil {
+		return FeedPage{}, err
+	}
+	var after *postKey
+	if cur != nil {
+		after = &cur.Last
+	}
+	sql, args := feedSQL(table, userIDs, q, after)
+	rows, err := pool.Query(ctx, sql, args...)
+	if err != nil {
+		return FeedPage{}, fmt.Errorf("query %s: %w", table, err)
+	}
+	posts, err := scanPosts(rows)
+	if err != nil {
+		return FeedPage{}, err
+	}
+	page := FeedPage{Posts: posts}
+	if len(posts) == q.Limit {
+		page.NextPageToken = pageCursor{Last: keyOf(posts[len(posts)-1])}.encode()
+	}
+	return page, nil
+}
+
+// scanPosts reads all rows of a feed statement and closes them.
+func scanPosts(rows pgx.Rows) ([]model.Post, error) {
+	defer rows.Close()
+	var res []model.Post
+	for rows.Next() {
+		var p model.Post
+		if err := rows.Scan(&p.ID, &p.UserID, &p.CreatedAt, &p.Content); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
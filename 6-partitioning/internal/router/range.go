@@ -3,7 +3,6 @@ package router
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"partitioning/ready/internal/model"
 
@@ -16,36 +15,50 @@ type RangeRouter struct {
 	DB *pgxpool.Pool
 }
 
-// GetFeed hits the partitioned table (posts_range). We align the predicate to the current month
-// so the planner can prune to exactly one monthly partition.
+// GetFeed hits the partitioned table (posts_range). Without an explicit cutoff the
+// predicate is aligned to the current month, so the planner can prune to exactly
+// one monthly partition.
 func (r *RangeRouter) GetFeed(ctx context.Context, userIDs []int64, limit int) ([]model.Post, error) {
+	return r.QueryFeed(ctx, userIDs, QueryFromContext(ctx, limit))
+}
+
+// QueryFeed runs q against posts_range. Only the partitions overlapping
+// [q.Since, q.Until) are scanned.
+func (r *RangeRouter) QueryFeed(ctx context.Context, userIDs []int64, q FeedQuery) ([]model.Post, error) {
+	page, err := r.QueryFeedPage(ctx, userIDs, q)
+	return page.Posts, err
+}
+
+// QueryFeedPage returns one page of q. The keyset predicate on (created_at, id) keeps
+// pruning intact: later pages only touch partitions older than the previous page.
+func (r *RangeRouter) QueryFeedPage(ctx context.Context, userIDs []int64, q FeedQuery) (FeedPage, error) {
 	if r.DB == nil {
-		return nil, fmt.Errorf("db is nil")
+		return FeedPage{}, fmt.Errorf("db is nil")
 	}
-	// Use a month-aligned window for clear pruning on monthly partitions.
-	now := time.Now()
-	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
-	monthEnd := monthStart.AddDate(0, 1, 0)
-	const q = `
-	SELECT id, user_id, created_at, content
-	FROM posts_range
-	WHERE user_id = ANY($1) AND created_at >= $2 AND created_at < $3
-	ORDER BY created_at DESC
-	LIMIT $4;
-	`
-	rows, err := r.DB.Query(ctx, q, userIDs, monthStart, monthEnd, limit)
-	if err != nil {
-		return nil, fmt.Errorf("query range: %w", err)
+	if err := q.Validate(); err != nil {
+		return FeedPage{}, err
 	}
-	defer rows.Close()
-
-	var res []model.Post
-	for rows.Next() {
-		var p model.Post
-		if err := rows.Scan(&p.ID, &p.UserID, &p.CreatedAt, &p.Content); err != nil {
-			return nil, fmt.Errorf("scan: %w", err)
-		}
-		res = append(res, p)
+	return queryTablePage(ctx, r.DB, "posts_range", userIDs, q)
+}
+
+// InsertPost stores p through the posts_range parent; Postgres routes the row to the
+// monthly partition covering p.CreatedAt (and fails if that partition does not exist).
+func (r *RangeRouter) InsertPost(ctx context.Context, p model.Post) (model.Post, error) {
+	return firstPost(r.InsertPosts(ctx, []model.Post{p}))
+}
+
+// InsertPosts stores posts in a single batch round-trip.
+func (r *RangeRouter) InsertPosts(ctx context.Context, posts []model.Post) ([]model.Post, error) {
+	if r.DB == nil {
+		return nil, fmt.Errorf("db is nil")
+	}
+	return insertPosts(ctx, r.DB, "posts_range", posts, false)
+}
+
+// DeletePost removes a post from whichever partition holds it.
+func (r *RangeRouter) DeletePost(ctx context.Context, userID, postID int64) error {
+	if r.DB == nil {
+		return fmt.Errorf("db is nil")
 	}
-	return res, rows.Err()
+	return deletePost(ctx, r.DB, "posts_range", userID, postID)
 }
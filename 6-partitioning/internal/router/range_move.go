@@ -0,0 +1,123 @@
+package router
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UserHashKey maps a key hash onto the BIGINT user_hash column. Flipping the sign bit
+// keeps the order (0 becomes MinInt64, 2^64-1 becomes MaxInt64), so a HashRange is
+// one index range scan on user_hash.
+func UserHashKey(h uint64) int64 {
+	return int64(h ^ 1<<63)
+}
+
+// rangeWhere returns the user_hash predicate selecting r, with its arguments
+// numbered from $n.
+func rangeWhere(r HashRange, n int) (string, []any) {
+	if r.End == 0 {
+		return fmt.Sprintf("user_hash >= $%d", n), []any{UserHashKey(r.Start)}
+	}
+	return fmt.Sprintf("user_hash >= $%d AND user_hash < $%d", n, n+1), []any{UserHashKey(r.Start), UserHashKey(r.End)}
+}
+
+// CountRange returns the number of rows of table on pool whose user_hash is in r.
+func CountRange(ctx context.Context, pool *pgxpool.Pool, table string, r HashRange) (int64, error) {
+	where, args := rangeWhere(r, 1)
+	var n int64
+	if err := pool.QueryRow(ctx, fmt.Sprintf(`SELECT count(*) FROM %s WHERE %s`, table, where), args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("count %s: %w", table, err)
+	}
+	return n, nil
+}
+
+// MoveRange moves the rows of table whose user_hash is in r from src to dst with a
+// verified copy (see MoveRows). It returns the number of rows moved.
+func MoveRange(ctx context.Context, src, dst *pgxpool.Pool, table string, r HashRange, batchSize int) (int64, error) {
+	where, args := rangeWhere(r, 1)
+	st, err := MoveRows(ctx, src, dst, MoveSpec{Table: table, Where: where, Args: args, OrderBy: "user_hash, id", BatchSize: batchSize})
+	return st.Rows, err
+}
+
+// CopyRange copies the rows of table whose user_hash is in r from src to dst and
+// leaves them on src (see MoveSpec.Keep). It returns the number of rows copied.
+func CopyRange(ctx context.Context, src, dst *pgxpool.Pool, table string, r HashRange, batchSize int) (int64, error) {
+	where, args := rangeWhere(r, 1)
+	st, err := MoveRows(ctx, src, dst, MoveSpec{Table: table, Where: where, Args: args, BatchSize: batchSize, Keep: true})
+	return st.Rows, err
+}
+
+// VerifyRange compares the row count and checksum of the rows of r on src and dst
+// and wraps ErrMoveVerify if they differ.
+func VerifyRange(ctx context.Context, src, dst *pgxpool.Pool, table string, r HashRange) error {
+	where, args := rangeWhere(r, 1)
+	want, err := rowsChecksum(ctx, src, table, where, args...)
+	if err != nil {
+		return err
+	}
+	got, err := rowsChecksum(ctx, dst, table, where, args...)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%s [%d, %d): %w: source %s, destination %s", table, r.Start, r.End, ErrMoveVerify, want, got)
+	}
+	return nil
+}
+
+// MoveRanges runs MoveRange for every move, from pools[From] to pools[To], and
+// returns the rows moved per move.
+func MoveRanges(ctx context.Context, from, to []*pgxpool.Pool, table string, moves []RangeMove, batchSize int) ([]int64, error) {
+	counts := make([]int64, len(moves))
+	for i, m := range moves {
+		if m.From >= len(from) || from[m.From] == nil || m.To >= len(to) || to[m.To] == nil {
+			return counts, fmt.Errorf("move %d -> %d: no pool", m.From, m.To)
+		}
+		n, err := MoveRange(ctx, from[m.From], to[m.To], table, m.HashRange, batchSize)
+		counts[i] = n
+		if err != nil {
+			return counts, fmt.Errorf("move %d -> %d [%d, %d): %w", m.From, m.To, m.Start, m.End, err)
+		}
+	}
+	return counts, nil
+}
+
+// BackfillUserHash fills user_hash for the rows of table on pool that have none
+// (written before the column existed), batchSize users at a time. It returns the
+// number of rows updated.
+func BackfillUserHash(ctx context.Context, pool *pgxpool.Pool, table string, batchSize int) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	selectSQL := fmt.Sprintf(`SELECT DISTINCT user_id FROM %s WHERE user_hash IS NULL LIMIT $1`, table)
+	updateSQL := fmt.Sprintf(`
+	UPDATE %s AS t SET user_hash = v.h
+	FROM unnest($1::bigint[], $2::bigint[]) AS v(u, h)
+	WHERE t.user_id = v.u AND t.user_hash IS NULL`, table)
+	var updated int64
+	for {
+		rows, err := pool.Query(ctx, selectSQL, batchSize)
+		if err != nil {
+			return updated, fmt.Errorf("backfill %s: %w", table, err)
+		}
+		users, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+		if err != nil {
+			return updated, fmt.Errorf("backfill %s: %w", table, err)
+		}
+		if len(users) == 0 {
+			return updated, nil
+		}
+		hashes := make([]int64, len(users))
+		for i, u := range users {
+			hashes[i] = UserHashKey(HashUser(u))
+		}
+		tag, err := pool.Exec(ctx, updateSQL, users, hashes)
+		if err != nil {
+			return updated, fmt.Errorf("backfill %s: %w", table, err)
+		}
+		updated += tag.RowsAffected()
+	}
+}
@@ -0,0 +1,350 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"partitioning/ready/internal/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// RebalancePhase is the step of an online move from one ShardRing to another. Routers
+// following a RebalanceStore route every request by the phase current when it starts:
+//
+//	stable      one ring; users are read from and written to their owner
+//	dual-write  reads go to the old owner; writes and deletes go to both owners
+//	backfill    as dual-write, while the Rebalancer copies existing rows to the new owner
+//	dual-read   reads query both owners and drop duplicates by post ID; writes go to both
+//	cutover     reads and writes go to the new owner; deletes still go to both
+//	cleanup     as cutover, while the Rebalancer deletes the moved rows from the old owner
+//	            once it has verified them on the new one
+//
+// Two adjacent phases route compatibly, so the Rebalancer only has to wait until no
+// router is more than one phase behind (RebalanceOptions.Poll) before the next step.
+type RebalancePhase string
+
+const (
+	PhaseStable    RebalancePhase = "stable"
+	PhaseDualWrite RebalancePhase = "dual-write"
+	PhaseBackfill  RebalancePhase = "backfill"
+	PhaseDualRead  RebalancePhase = "dual-read"
+	PhaseCutover   RebalancePhase = "cutover"
+	PhaseCleanup   RebalancePhase = "cleanup"
+)
+
+// next returns the phase after p; cleanup ends in stable.
+func (p RebalancePhase) next() RebalancePhase {
+	switch p {
+	case PhaseStable:
+		return PhaseDualWrite
+	case PhaseDualWrite:
+		return PhaseBackfill
+	case PhaseBackfill:
+		return PhaseDualRead
+	case PhaseDualRead:
+		return PhaseCutover
+	case PhaseCutover:
+		return PhaseCleanup
+	}
+	return PhaseStable
+}
+
+func (p RebalancePhase) valid() bool {
+	switch p {
+	case PhaseStable, PhaseDualWrite, PhaseBackfill, PhaseDualRead, PhaseCutover, PhaseCleanup:
+		return true
+	}
+	return false
+}
+
+// cutOver reports whether the new ring owns reads and writes.
+func (p RebalancePhase) cutOver() bool {
+	return p == PhaseCutover || p == PhaseCleanup
+}
+
+// writesShadow reports whether inserts also go to the other owner.
+func (p RebalancePhase) writesShadow() bool {
+	return p == PhaseDualWrite || p == PhaseBackfill || p == PhaseDualRead
+}
+
+// readsShadow reports whether reads also query the other owner.
+func (p RebalancePhase) readsShadow() bool {
+	return p == PhaseDualRead
+}
+
+// deletesShadow reports whether deletes also go to the other owner. Deletes keep going
+// to the old owner until the end, so a router still in dual-read does not read a post
+// back from it and cleanup does not find it there to verify.
+func (p RebalancePhase) deletesShadow() bool {
+	return p != PhaseStable
+}
+
+// RebalanceState is the placement routers follow: a ring and, while a rebalance is in
+// progress, the ring it moves to.
+type RebalanceState struct {
+	Phase RebalancePhase
+	// From is the ring the data is placed by; after cleanup it is replaced by To.
+	From *ShardRing
+	// To is the target ring, nil in PhaseStable.
+	To        *ShardRing
+	UpdatedAt time.Time
+}
+
+// layout returns the placement of the state: the owning ring by phase and, while both
+// rings hold a user, the other one as shadow. Pools are indexed by slot over both rings.
+func (s *RebalanceState) layout() (shardLayout, error) {
+	if s.From == nil || len(s.From.Shards()) == 0 {
+		return shardLayout{}, fmt.Errorf("router not initialized")
+	}
+	if id := s.From.missingPool(); id != "" {
+		return shardLayout{}, fmt.Errorf("shard %s has no pool", id)
+	}
+	if s.Phase == PhaseStable || s.To == nil {
+		return shardLayout{part: s.From, pools: s.From.Pools(), ids: s.From.ids}, nil
+	}
+	if id := s.To.missingPool(); id != "" {
+		return shardLayout{}, fmt.Errorf("shard %s has no pool", id)
+	}
+	pools := s.To.Pools()
+	for slot, p := range s.From.Pools() {
+		if slot >= len(pools) {
+			pools = append(pools, p)
+		} else if pools[slot] == nil {
+			pools[slot] = p
+		}
+	}
+	// Slots name the same shard in both rings (see checkSlots); To knows every slot
+	// of From, since rings only ever append slots.
+	ids := s.To.ids
+	if len(s.From.ids) > len(ids) {
+		ids = s.From.ids
+	}
+	l := shardLayout{part: s.From, shadow: s.To, phase: s.Phase, pools: pools, ids: ids}
+	if s.Phase.cutOver() {
+		l.part, l.shadow = s.To, s.From
+	}
+	return l, nil
+}
+
+// checkSlots fails unless every shard on both rings has the same slot in each, which
+// holds when next was derived from prev with Add and Remove.
+func checkSlots(prev, next *ShardRing) error {
+	for id, slot := range prev.slots {
+		if s, ok := next.slots[id]; ok && s != slot {
+			return fmt.Errorf("shard %s has slot %d in epoch %d and %d in epoch %d", id, slot, prev.Version(), s, next.Version())
+		}
+	}
+	return nil
+}
+
+// RebalanceOptions tunes a RebalanceStore.
+type RebalanceOptions struct {
+	// Table is the state table (default: rebalance_state, see sql/rebalance_schema.sql).
+	Table string
+	// Name identifies the rebalanced data, one row per name (default: posts_hash).
+	Name string
+	// Poll is how often Watch re-reads the state (default: 1s). It bounds how long a
+	// router misses a phase change when Listen is not running.
+	Poll time.Duration
+}
+
+// rebalanceChannel is the NOTIFY channel carrying the names whose state changed.
+const rebalanceChannel = "rebalance_state"
+
+// RebalanceStore keeps the RebalanceState of one sharded table in a table, so routers
+// in several processes follow the same phase. Routers read the cached state (Load);
+// Watch and Listen keep it current.
+type RebalanceStore struct {
+	pool    *pgxpool.Pool
+	resolve PoolResolver
+	opts    RebalanceOptions
+	cur     atomic.Pointer[RebalanceState]
+}
+
+// NewRebalanceStore returns a store in a table on pool. resolve supplies the pools of
+// the shards on the stored rings, e.g. Topology.ShardPool.
+func NewRebalanceStore(pool *pgxpool.Pool, resolve PoolResolver, opts RebalanceOptions) *RebalanceStore {
+	if opts.Table == "" {
+		opts.Table = "rebalance_state"
+	}
+	if opts.Name == "" {
+		opts.Name = "posts_hash"
+	}
+	if opts.Poll <= 0 {
+		opts.Poll = time.Second
+	}
+	return &RebalanceStore{pool: pool, resolve: resolve, opts: opts}
+}
+
+// Load returns the last state read, or nil before the first Refresh.
+func (s *RebalanceStore) Load() *RebalanceState {
+	return s.cur.Load()
+}
+
+// Refresh reads the state from the table and returns it.
+func (s *RebalanceStore) Refresh(ctx context.Context) (*RebalanceState, error) {
+	var phase string
+	var fromData, toData []byte
+	var updated time.Time
+	err := s.pool.QueryRow(ctx, fmt.Sprintf(`SELECT phase, from_ring, to_ring, updated_at FROM %s WHERE name = $1`, s.opts.Table), s.opts.Name).
+		Scan(&phase, &fromData, &toData, &updated)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("no rebalance state for %s (see RebalanceStore.Init)", s.opts.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read rebalance state: %w", err)
+	}
+	if cur := s.cur.Load(); cur != nil && cur.UpdatedAt.Equal(updated) && string(cur.Phase) == phase {
+		return cur, nil
+	}
+	st := &RebalanceState{Phase: RebalancePhase(phase), UpdatedAt: updated}
+	if !st.Phase.valid() {
+		return nil, fmt.Errorf("rebalance state %s: unknown phase %q", s.opts.Name, phase)
+	}
+	if st.From, err = s.ring(fromData); err != nil {
+		return nil, fmt.Errorf("rebalance state %s: from: %w", s.opts.Name, err)
+	}
+	if toData != nil {
+		if st.To, err = s.ring(toData); err != nil {
+			return nil, fmt.Errorf("rebalance state %s: to: %w", s.opts.Name, err)
+		}
+		if err := checkSlots(st.From, st.To); err != nil {
+			return nil, fmt.Errorf("rebalance state %s: %w", s.opts.Name, err)
+		}
+	}
+	if st.Phase != PhaseStable && st.To == nil {
+		return nil, fmt.Errorf("rebalance state %s: phase %s without a target ring", s.opts.Name, st.Phase)
+	}
+	s.cur.Store(st)
+	return st, nil
+}
+
+func (s *RebalanceStore) ring(data []byte) (*ShardRing, error) {
+	return ringFromJSON(data, s.resolve)
+}
+
+// Init stores ring as the stable placement, replacing a stable state but never a
+// rebalance in progress.
+func (s *RebalanceStore) Init(ctx context.Context, ring *ShardRing) error {
+	sql := fmt.Sprintf(`
+	WITH up AS (
+		INSERT INTO %s AS t (name, phase, from_ring, to_ring, updated_at) VALUES ($1, $2, $3, NULL, clock_timestamp())
+		ON CONFLICT (name) DO UPDATE SET from_ring = EXCLUDED.from_ring, to_ring = NULL, updated_at = EXCLUDED.updated_at
+		WHERE t.phase = $2
+		RETURNING name
+	)
+	SELECT pg_notify($4, name) FROM up;`, s.opts.Table)
+	tag, err := s.pool.Exec(ctx, sql, s.opts.Name, string(PhaseStable), ring.Spec(), rebalanceChannel)
+	if err != nil {
+		return fmt.Errorf("init rebalance state %s: %w", s.opts.Name, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("init rebalance state %s: a rebalance is in progress", s.opts.Name)
+	}
+	_, err = s.Refresh(ctx)
+	return err
+}
+
+// advance moves the stored state from phase from to next, failing if another process
+// changed it first, and notifies the other processes.
+func (s *RebalanceStore) advance(ctx context.Context, from RebalancePhase, next RebalanceState) (*RebalanceState, error) {
+	var to any
+	if next.To != nil {
+		to = next.To.Spec()
+	}
+	sql := fmt.Sprintf(`
+	WITH up AS (
+		UPDATE %s SET phase = $3, from_ring = $4, to_ring = $5, updated_at = clock_timestamp()
+		WHERE name = $1 AND phase = $2
+		RETURNING name
+	)
+	SELECT pg_notify($6, name) FROM up;`, s.opts.Table)
+	tag, err := s.pool.Exec(ctx, sql, s.opts.Name, string(from), string(next.Phase), next.From.Spec(), to, rebalanceChannel)
+	if err != nil {
+		return nil, fmt.Errorf("rebalance %s: %s -> %s: %w", s.opts.Name, from, next.Phase, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, fmt.Errorf("rebalance %s: %s -> %s: the state is no longer %s", s.opts.Name, from, next.Phase, from)
+	}
+	return s.Refresh(ctx)
+}
+
+// Watch re-reads the state every RebalanceOptions.Poll until ctx is done. A failed read
+// keeps the previous state.
+func (s *RebalanceStore) Watch(ctx context.Context) {
+	t := time.NewTicker(s.opts.Poll)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			_, _ = s.Refresh(ctx)
+		}
+	}
+}
+
+// Listen re-reads the state whenever another process changes it, until ctx is done.
+// It holds one connection of the pool for LISTEN. Notifications sent while it is not
+// connected are lost, so it re-reads the state each time it (re)starts listening.
+func (s *RebalanceStore) Listen(ctx context.Context) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("rebalance listen: %w", err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "LISTEN "+rebalanceChannel); err != nil {
+		return fmt.Errorf("rebalance listen: %w", err)
+	}
+	if _, err := s.Refresh(ctx); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// The connection state is unknown; do not hand it back to the pool.
+			conn.Conn().Close(context.Background())
+			return fmt.Errorf("rebalance listen: %w", err)
+		}
+		if n.Payload == s.opts.Name {
+			if _, err := s.Refresh(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// mirrorPosts writes posts, which already carry their IDs, to the shadow owner of
+// every user that has one. Rows already there are kept, since the Rebalancer may have
+// copied them first, so mirroring the same posts again is safe. Every shadow shard is
+// tried; the errors of those that failed are joined.
+func mirrorPosts(ctx context.Context, l shardLayout, table string, shardFor func(int64) int, posts []model.Post) error {
+	perShard := make(map[int][]model.Post)
+	for _, p := range posts {
+		if s, ok := l.shadowFor(p.UserID, shardFor(p.UserID)); ok {
+			perShard[s] = append(perShard[s], p)
+		}
+	}
+	sql := fmt.Sprintf(`INSERT INTO %s (id, user_id, created_at, content, user_hash) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id) DO NOTHING`, table)
+	var errs []error
+	for s, ps := range perShard {
+		batch := &pgx.Batch{}
+		for _, p := range ps {
+			batch.Queue(sql, p.ID, p.UserID, p.CreatedAt, p.Content, UserHashKey(HashUser(p.UserID)))
+		}
+		if err := l.pools[s].SendBatch(ctx, batch).Close(); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: mirror into %s: %w", s, table, err))
+			continue
+		}
+		sessionFrom(ctx).wrote(l.id(s))
+	}
+	return errors.Join(errs...)
+}
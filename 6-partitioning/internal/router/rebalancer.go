@@ -0,0 +1,197 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Rebalancer moves a sharded table online from the ring of a RebalanceStore to a new
+// ring, stepping the stored state through every RebalancePhase while routers following
+// the store keep serving reads and writes.
+type Rebalancer struct {
+	Store *RebalanceStore
+	// Table is the sharded table (default: posts_hash).
+	Table string
+	// BatchSize is the number of rows per copy or delete batch (default: 1000).
+	BatchSize int
+	// RowsPerSecond caps how fast each range is copied and cleaned up (0: no limit).
+	RowsPerSecond int
+	// Settle is how long to wait after a phase change before relying on it, so every
+	// router has seen it (default: 3 × RebalanceOptions.Poll). Routers that only Watch
+	// need at least Poll, plus the longest request.
+	Settle time.Duration
+	// VerifyAttempts bounds how often a range is copied, verified or cleaned up again
+	// when its checksum does not match, e.g. because of concurrent writes (default: 3).
+	VerifyAttempts int
+	// OnPhase, if set, is called with every state the Rebalancer enters.
+	OnPhase func(*RebalanceState)
+	// Keep lists pools Decommission never closes besides the store's, e.g.
+	// Topology.Baseline when other control tables live there.
+	Keep []*pgxpool.Pool
+}
+
+func (rb *Rebalancer) table() string {
+	if rb.Table == "" {
+		return "posts_hash"
+	}
+	return rb.Table
+}
+
+func (rb *Rebalancer) settle(ctx context.Context) error {
+	d := rb.Settle
+	if d <= 0 {
+		d = 3 * rb.Store.opts.Poll
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Run moves the data to ring to and returns once the state is stable on it. If a
+// rebalance is already in progress, Run resumes it from its stored phase; to may then
+// be nil, or must be the ring being moved to. Every phase can be repeated, so Run can
+// be restarted after a failure or crash.
+func (rb *Rebalancer) Run(ctx context.Context, to *ShardRing) error {
+	st, err := rb.Store.Refresh(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case st.Phase == PhaseStable && to == nil:
+		return nil
+	case st.Phase == PhaseStable:
+		if to.Version() <= st.From.Version() {
+			return fmt.Errorf("ring epoch %d is not newer than %d", to.Version(), st.From.Version())
+		}
+		if err := checkSlots(st.From, to); err != nil {
+			return err
+		}
+	case to != nil && to.Version() != st.To.Version():
+		return fmt.Errorf("a rebalance to epoch %d is in progress", st.To.Version())
+	}
+	if to == nil {
+		to = st.To
+	}
+	for {
+		if rb.OnPhase != nil {
+			rb.OnPhase(st)
+		}
+		var err error
+		switch st.Phase {
+		case PhaseStable:
+			if st.From.Version() == to.Version() {
+				return nil
+			}
+		case PhaseDualWrite, PhaseCutover:
+			// Routers must all mirror writes (dual-write) or read the new owner
+			// (cutover) before the rows of the old owner are copied or deleted.
+			err = rb.settle(ctx)
+		case PhaseBackfill:
+			err = rb.copyMoved(ctx, st)
+		case PhaseDualRead:
+			if err = rb.settle(ctx); err == nil {
+				err = rb.verifyMoved(ctx, st)
+			}
+		case PhaseCleanup:
+			if err = rb.deleteMoved(ctx, st); err == nil {
+				err = rb.checkDrained(ctx, st)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("rebalance %s: %w", st.Phase, err)
+		}
+		next := RebalanceState{Phase: st.Phase.next(), From: st.From, To: to}
+		if next.Phase == PhaseStable {
+			next.From, next.To = to, nil
+		}
+		if st, err = rb.Store.advance(ctx, st.Phase, next); err != nil {
+			return err
+		}
+	}
+}
+
+// copyMoved copies every range that changes owner to its new owner.
+func (rb *Rebalancer) copyMoved(ctx context.Context, st *RebalanceState) error {
+	return rb.eachMove(st, "copy", func(src, dst *pgxpool.Pool, r HashRange) error {
+		_, err := MoveRows(ctx, src, dst, rb.rangeSpec(r, true))
+		return err
+	})
+}
+
+// verifyMoved checks that the new owner of every moved range holds the same rows as
+// the old one. A range that differs is copied again, which also picks up writes whose
+// mirror failed during backfill.
+func (rb *Rebalancer) verifyMoved(ctx context.Context, st *RebalanceState) error {
+	return rb.eachMove(st, "verify", func(src, dst *pgxpool.Pool, r HashRange) error {
+		if err := VerifyRange(ctx, src, dst, rb.table(), r); !errors.Is(err, ErrMoveVerify) {
+			return err
+		}
+		if _, err := MoveRows(ctx, src, dst, rb.rangeSpec(r, true)); err != nil {
+			return err
+		}
+		return VerifyRange(ctx, src, dst, rb.table(), r)
+	})
+}
+
+// deleteMoved deletes every moved range from its old owner with MoveRows, so every
+// batch is verified against the new owner before it is deleted. A batch that does not
+// match stays on the old owner.
+func (rb *Rebalancer) deleteMoved(ctx context.Context, st *RebalanceState) error {
+	return rb.eachMove(st, "clean up", func(src, dst *pgxpool.Pool, r HashRange) error {
+		_, err := MoveRows(ctx, src, dst, rb.rangeSpec(r, false))
+		return err
+	})
+}
+
+// checkDrained fails if a moved range still has rows on its old owner, so the ring
+// does not become stable while rows are left where no router reads them.
+func (rb *Rebalancer) checkDrained(ctx context.Context, st *RebalanceState) error {
+	return rb.eachMove(st, "check drained", func(src, dst *pgxpool.Pool, r HashRange) error {
+		n, err := CountRange(ctx, src, rb.table(), r)
+		if err == nil && n > 0 {
+			err = fmt.Errorf("%d rows left in [%d, %d)", n, r.Start, r.End)
+		}
+		return err
+	})
+}
+
+// eachMove runs fn for every range that changes owner between st.From and st.To,
+// with the pools of its old and new owner. A range failing with ErrMoveVerify, which
+// concurrent writes can cause, is retried up to VerifyAttempts times.
+func (rb *Rebalancer) eachMove(st *RebalanceState, step string, fn func(src, dst *pgxpool.Pool, r HashRange) error) error {
+	l, err := st.layout()
+	if err != nil {
+		return err
+	}
+	attempts := rb.VerifyAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	for _, m := range st.From.Diff(st.To) {
+		for i := 1; ; i++ {
+			err := fn(l.pools[m.From], l.pools[m.To], m.HashRange)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, ErrMoveVerify) || i == attempts {
+				return fmt.Errorf("%s %s -> %s: %w", step, st.From.ID(m.From), st.To.ID(m.To), err)
+			}
+		}
+	}
+	return nil
+}
+
+// rangeSpec selects the rows of r for MoveRows; keep leaves them on the source.
+func (rb *Rebalancer) rangeSpec(r HashRange, keep bool) MoveSpec {
+	where, args := rangeWhere(r, 1)
+	return MoveSpec{Table: rb.table(), Where: where, Args: args, OrderBy: "user_hash, id", BatchSize: rb.BatchSize, Keep: keep, RowsPerSecond: rb.RowsPerSecond}
+}
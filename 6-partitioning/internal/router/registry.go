@@ -0,0 +1,302 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"partitioning/ready/internal/db"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Built-in strategy names accepted by New.
+const (
+	ModeBaseline   = "baseline"
+	ModeRange      = "range"
+	ModeHash       = "hash"
+	ModeConsistent = "hash-consistent"
+	ModeDirectory  = "directory"
+)
+
+// Topology describes the connection pools a strategy is built from.
+// A strategy only uses the fields it needs; the rest may stay nil.
+type Topology struct {
+	// Baseline points at the instance with the non-partitioned posts table.
+	Baseline *pgxpool.Pool
+	// Range points at the instance with the partitioned posts_range table.
+	Range *pgxpool.Pool
+	// Shards are the independent shard instances (primaries), in shard index order.
+	Shards []*pgxpool.Pool
+	// ShardReplicas holds the read replicas of each shard, by shard index.
+	ShardReplicas [][]*pgxpool.Pool
+	// ReplicaReads configures how fan-out routers read from ShardReplicas.
+	ReplicaReads ReplicaOptions
+	// Standbys holds the failover target of each shard, by shard index (nil: none).
+	Standbys []*pgxpool.Pool
+	// Failover is the running shard monitor, if started with StartFailover.
+	Failover *ShardMonitor
+	// IDs assigns post IDs for the sharded modes' writes (see NodeID). Without it they
+	// only read.
+	IDs *IDGenerator
+	// Directory holds per-user shard pins for mode directory
+	// (default: shard_directory on Baseline).
+	Directory *Directory
+	// Table overrides the sharded table name (default: posts_hash).
+	Table string
+	// Replicas is the number of virtual nodes per shard on the ring (default: 200).
+	Replicas int
+	// Partitioner selects the consistent hashing scheme, see Schemes (default: ring).
+	Partitioner string
+	// Weights optionally gives each shard a relative share of users, by shard index.
+	Weights []float64
+	// Bounded configures Partitioner bounded (consistent hashing with bounded loads).
+	Bounded BoundedOptions
+	// Ring, if set, places users for modes hash-consistent and directory instead of
+	// Partitioner over Shards (see ConsistentHashRouter.Live), e.g. a topology file.
+	// The ring brings its own pools and weights, so those modes reject it together
+	// with replica reads, failover, Weights or a Partitioner other than ring.
+	Ring *ShardRing
+	// Rebalance, if set, takes precedence over Ring: modes hash-consistent and directory
+	// follow its stored state, including an online rebalance in progress. It takes the
+	// same options as Ring.
+	Rebalance *RebalanceStore
+	// Fanout configures the fan-out routers (exact merge, partial results).
+	Fanout FanoutOptions
+}
+
+// OpenTopology creates pools for the baseline instance, the range-partitioned table,
+// all shards, their replicas and standbys. pgxpool dials lazily, so a strategy only connects to
+// the pools it uses.
+func OpenTopology(ctx context.Context) (Topology, error) {
+	var t Topology
+	var err error
+	if t.Baseline, err = db.NewBaselinePool(ctx); err != nil {
+		return Topology{}, err
+	}
+	if t.Range, err = db.NewRangePool(ctx); err != nil {
+		t.Close()
+		return Topology{}, err
+	}
+	if t.Shards, err = db.NewShardPools(ctx); err != nil {
+		t.Close()
+		return Topology{}, err
+	}
+	if t.ShardReplicas, err = db.NewShardReplicaPools(ctx); err != nil {
+		t.Close()
+		return Topology{}, err
+	}
+	if t.Standbys, err = db.NewShardStandbyPools(ctx); err != nil {
+		t.Close()
+		return Topology{}, err
+	}
+	return t, nil
+}
+
+// Close closes every pool in the topology.
+func (t Topology) Close() {
+	if t.Baseline != nil {
+		t.Baseline.Close()
+	}
+	if t.Range != nil {
+		t.Range.Close()
+	}
+	for _, p := range t.Shards {
+		p.Close()
+	}
+	for _, ps := range t.ShardReplicas {
+		for _, p := range ps {
+			p.Close()
+		}
+	}
+	for _, p := range t.Standbys {
+		if p != nil {
+			p.Close()
+		}
+	}
+}
+
+// StartFailover starts a ShardMonitor over the shards and their standbys, running until
+// ctx is done. Routers built from t afterwards follow its failovers.
+func (t *Topology) StartFailover(ctx context.Context, opts FailoverOptions) *ShardMonitor {
+	t.Failover = NewShardMonitor(t.Shards, t.Standbys, opts)
+	go t.Failover.Run(ctx)
+	return t.Failover
+}
+
+// ShardPool resolves a shard ID to its pool: shard hosts (db.ShardHosts) to Shards,
+// and the baseline host to Baseline. It is a PoolResolver for topology files.
+func (t Topology) ShardPool(id ShardID) (*pgxpool.Pool, error) {
+	for i, h := range db.ShardHosts() {
+		if ShardID(h) == id && i < len(t.Shards) {
+			return t.Shards[i], nil
+		}
+	}
+	if id == db.BaselineHost && t.Baseline != nil {
+		return t.Baseline, nil
+	}
+	return nil, fmt.Errorf("no pool for shard %s", id)
+}
+
+// reads builds replica routing for the shards, or returns nil if no shard has replicas.
+func (t Topology) reads() *ReadReplicas {
+	for _, ps := range t.ShardReplicas {
+		if len(ps) > 0 {
+			return NewReadReplicas(t.ShardReplicas, t.ReplicaReads)
+		}
+	}
+	return nil
+}
+
+// Factory builds a FeedRouter from a topology.
+type Factory func(t Topology) (FeedRouter, error)
+
+var registry = struct {
+	sync.RWMutex
+	factories map[string]Factory
+}{factories: make(map[string]Factory)}
+
+// Register makes a strategy available under the given mode name.
+// It panics if the name is empty, the factory is nil, or the name is already taken,
+// because that is always a programming error.
+func Register(mode string, f Factory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if mode == "" || f == nil {
+		panic("router: Register with empty mode or nil factory")
+	}
+	if _, dup := registry.factories[mode]; dup {
+		panic("router: Register called twice for mode " + mode)
+	}
+	registry.factories[mode] = f
+}
+
+// New builds the router registered under mode.
+func New(mode string, t Topology) (FeedRouter, error) {
+	registry.RLock()
+	f, ok := registry.factories[mode]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown mode %q (available: %v)", mode, Modes())
+	}
+	r, err := f(t)
+	if err != nil {
+		return nil, fmt.Errorf("build %s router: %w", mode, err)
+	}
+	return r, nil
+}
+
+// Modes returns the registered mode names in sorted order.
+func Modes() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	modes := make([]string, 0, len(registry.factories))
+	for m := range registry.factories {
+		modes = append(modes, m)
+	}
+	sort.Strings(modes)
+	return modes
+}
+
+func init() {
+	Register(ModeBaseline, func(t Topology) (FeedRouter, error) {
+		if t.Baseline == nil {
+			return nil, fmt.Errorf("baseline pool is nil")
+		}
+		return &BaselineRouter{DB: t.Baseline}, nil
+	})
+	Register(ModeRange, func(t Topology) (FeedRouter, error) {
+		if t.Range == nil {
+			return nil, fmt.Errorf("range pool is nil")
+		}
+		return &RangeRouter{DB: t.Range}, nil
+	})
+	Register(ModeHash, func(t Topology) (FeedRouter, error) {
+		if len(t.Shards) == 0 {
+			return nil, fmt.Errorf("no shards")
+		}
+		return &HashRouter{Shards: t.Shards, IDs: t.IDs, Reads: t.reads(), Failover: t.Failover, FanoutOptions: t.Fanout}, nil
+	})
+	Register(ModeConsistent, func(t Topology) (FeedRouter, error) {
+		return newConsistent(t)
+	})
+	Register(ModeDirectory, func(t Topology) (FeedRouter, error) {
+		ring, err := newConsistent(t)
+		if err != nil {
+			return nil, err
+		}
+		dir := t.Directory
+		if dir == nil {
+			if t.Baseline == nil {
+				return nil, fmt.Errorf("baseline pool is nil (needed for the directory)")
+			}
+			dir = NewDirectory(t.Baseline, DirectoryOptions{})
+		}
+		return &DirectoryRouter{ConsistentHashRouter: ring, Directory: dir}, nil
+	})
+}
+
+// newConsistent builds a ConsistentHashRouter partitioning users over all shards of t,
+// or by t.Rebalance or t.Ring if set.
+func newConsistent(t Topology) (*ConsistentHashRouter, error) {
+	if t.Rebalance != nil || t.Ring != nil {
+		if err := t.ringOptions(); err != nil {
+			return nil, err
+		}
+	}
+	if t.Rebalance != nil {
+		return &ConsistentHashRouter{Rebalance: t.Rebalance, Table: t.Table, IDs: t.IDs, FanoutOptions: t.Fanout}, nil
+	}
+	if t.Ring != nil {
+		return &ConsistentHashRouter{Live: NewLiveRing(t.Ring), Table: t.Table, IDs: t.IDs, FanoutOptions: t.Fanout}, nil
+	}
+	if len(t.Shards) == 0 {
+		return nil, fmt.Errorf("no shards")
+	}
+	replicas := t.Replicas
+	if replicas <= 0 {
+		replicas = 200
+	}
+	ids := make([]int, 0, len(t.Shards))
+	for i := range t.Shards {
+		ids = append(ids, i)
+	}
+	p, err := NewPartitioner(t.Partitioner, ids, t.Weights, replicas)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := p.(*BoundedLoad); ok {
+		if t.Bounded.Users <= 0 {
+			return nil, fmt.Errorf("partitioner %s needs Bounded.Users: live loads are for stateless traffic, not stored posts", SchemeBounded)
+		}
+		if err := b.configure(t.Bounded); err != nil {
+			return nil, err
+		}
+	}
+	r := &ConsistentHashRouter{Shards: t.Shards, Partitioner: p, Table: t.Table, IDs: t.IDs, Reads: t.reads(), Failover: t.Failover, FanoutOptions: t.Fanout}
+	if hosts := db.ShardHosts(); len(hosts) == len(t.Shards) {
+		r.ShardIDs = make([]ShardID, len(hosts))
+		for i, h := range hosts {
+			r.ShardIDs[i] = ShardID(h)
+		}
+	}
+	return r, nil
+}
+
+// ringOptions reports the options of t that a router placing users by Ring or
+// Rebalance does not support: replicas and standbys are by shard index, which a ring
+// change shifts, and the ring carries its own scheme and weights.
+func (t Topology) ringOptions() error {
+	switch {
+	case t.reads() != nil:
+		return fmt.Errorf("replica reads are not supported with a ring or rebalance store")
+	case t.Failover != nil:
+		return fmt.Errorf("failover is not supported with a ring or rebalance store")
+	case t.Partitioner != "" && t.Partitioner != SchemeRing:
+		return fmt.Errorf("partitioner %q is not supported with a ring or rebalance store", t.Partitioner)
+	case t.Weights != nil:
+		return fmt.Errorf("weights are not supported with a ring or rebalance store, set them on the ring")
+	}
+	return nil
+}
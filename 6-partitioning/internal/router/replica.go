@@ -0,0 +1,220 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ReplicaBalance selects how reads are spread over a shard's replicas.
+type ReplicaBalance string
+
+const (
+	// BalanceRoundRobin sends reads to the eligible replicas in turn.
+	BalanceRoundRobin ReplicaBalance = "round-robin"
+	// BalanceLeastOutstanding sends a read to the eligible replica with the fewest queries in flight.
+	BalanceLeastOutstanding ReplicaBalance = "least-outstanding"
+)
+
+// ReplicaOptions configures read routing to replicas.
+type ReplicaOptions struct {
+	// Balance picks among eligible replicas (default: round-robin).
+	Balance ReplicaBalance
+	// MaxLag skips replicas whose replication lag is above it. Zero disables the check.
+	// A replica whose lag has not been measured yet, or could not be, is skipped too.
+	MaxLag time.Duration
+	// LagInterval is how often each replica's lag is re-measured (default: 1s).
+	// Measurements run in the background, triggered by reads.
+	LagInterval time.Duration
+	// PinFor is how long a Session reads a shard from its primary after writing to it.
+	// Zero pins the shard for the rest of the session.
+	PinFor time.Duration
+}
+
+// ReadReplicas routes shard reads to replicas. When no replica of a shard is eligible,
+// the read goes to the shard's primary. A nil *ReadReplicas reads from primaries only.
+type ReadReplicas struct {
+	opts   ReplicaOptions
+	shards [][]*replica // by shard index
+	next   []atomic.Uint64
+}
+
+// replica is one replica pool with its load and lag.
+type replica struct {
+	pool      *pgxpool.Pool
+	inflight  atomic.Int64
+	lag       atomic.Int64 // nanoseconds; -1 until measured or after a failed check
+	checkedAt atomic.Int64 // unix nanoseconds of the last lag check start
+	checking  atomic.Bool
+}
+
+// NewReadReplicas builds read routing over replicas, given per shard index.
+func NewReadReplicas(replicas [][]*pgxpool.Pool, opts ReplicaOptions) *ReadReplicas {
+	if opts.Balance == "" {
+		opts.Balance = BalanceRoundRobin
+	}
+	if opts.LagInterval <= 0 {
+		opts.LagInterval = time.Second
+	}
+	r := &ReadReplicas{opts: opts, shards: make([][]*replica, len(replicas)), next: make([]atomic.Uint64, len(replicas))}
+	for s, pools := range replicas {
+		for _, p := range pools {
+			rep := &replica{pool: p}
+			rep.lag.Store(-1)
+			r.shards[s] = append(r.shards[s], rep)
+		}
+	}
+	return r
+}
+
+// ParseReplicaBalance validates a balancing policy name.
+func ParseReplicaBalance(s string) (ReplicaBalance, error) {
+	switch b := ReplicaBalance(s); b {
+	case BalanceRoundRobin, BalanceLeastOutstanding:
+		return b, nil
+	}
+	return "", fmt.Errorf("unknown replica balance %q (available: %s, %s)", s, BalanceRoundRobin, BalanceLeastOutstanding)
+}
+
+// pick returns the pool to read shard (named id) from: an eligible replica, or primary
+// if there is none or ctx carries a Session that recently wrote to the shard. The
+// returned replica is nil when primary is used.
+func (r *ReadReplicas) pick(ctx context.Context, shard int, id ShardID, primary *pgxpool.Pool) (*pgxpool.Pool, *replica) {
+	if r == nil || shard >= len(r.shards) || len(r.shards[shard]) == 0 {
+		return primary, nil
+	}
+	if sessionFrom(ctx).pinned(id, r.opts.PinFor) {
+		return primary, nil
+	}
+	reps := r.shards[shard]
+	var chosen *replica
+	switch r.opts.Balance {
+	case BalanceLeastOutstanding:
+		for _, rep := range reps {
+			if r.eligible(rep) && (chosen == nil || rep.inflight.Load() < chosen.inflight.Load()) {
+				chosen = rep
+			}
+		}
+	default:
+		start := r.next[shard].Add(1)
+		for i := range reps {
+			if rep := reps[(start+uint64(i))%uint64(len(reps))]; r.eligible(rep) {
+				chosen = rep
+				break
+			}
+		}
+	}
+	if chosen == nil {
+		return primary, nil
+	}
+	return chosen.pool, chosen
+}
+
+// eligible reports whether rep may serve reads, refreshing its lag in the background
+// when the last measurement is older than LagInterval.
+func (r *ReadReplicas) eligible(rep *replica) bool {
+	if r.opts.MaxLag <= 0 {
+		return true
+	}
+	if time.Since(time.Unix(0, rep.checkedAt.Load())) >= r.opts.LagInterval && rep.checking.CompareAndSwap(false, true) {
+		rep.checkedAt.Store(time.Now().UnixNano())
+		go func() {
+			defer rep.checking.Store(false)
+			ctx, cancel := context.WithTimeout(context.Background(), r.opts.LagInterval)
+			defer cancel()
+			rep.refreshLag(ctx)
+		}()
+	}
+	lag := rep.lag.Load()
+	return lag >= 0 && time.Duration(lag) <= r.opts.MaxLag
+}
+
+// replicaLagSQL measures how far a standby is behind. A standby that has replayed all the
+// WAL it received is up to date even if the primary has been idle for a while, but only
+// while its WAL receiver is streaming: once the upstream connection drops it receives
+// nothing, so the lag is unknown (NULL). Reading the receiver status needs a superuser
+// or pg_read_all_stats; without it the status is NULL and the lag unknown too.
+const replicaLagSQL = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN NOT EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming') THEN NULL
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+	END::float8;`
+
+// refreshLag measures the replica's lag. On failure, or if the replica is not streaming
+// from its primary, the lag becomes unknown, so the replica is skipped until a later
+// check succeeds.
+func (rep *replica) refreshLag(ctx context.Context) {
+	var secs *float64
+	if err := rep.pool.QueryRow(ctx, replicaLagSQL).Scan(&secs); err != nil || secs == nil {
+		rep.lag.Store(-1)
+		return
+	}
+	rep.lag.Store(int64(*secs * float64(time.Second)))
+}
+
+// begin and end count the queries in flight on a replica. Both accept nil (primary reads).
+func (rep *replica) begin() {
+	if rep != nil {
+		rep.inflight.Add(1)
+	}
+}
+
+func (rep *replica) end() {
+	if rep != nil {
+		rep.inflight.Add(-1)
+	}
+}
+
+// Session tracks the writes of one client so that its reads can see them
+// (read-your-writes). Attach it with WithSession to both writes and reads; after a
+// write to a shard, reads of that shard go to its primary for ReplicaOptions.PinFor.
+// Shards are tracked by ShardID, so a pin follows the shard when the topology changes.
+// A Session is safe for concurrent use.
+type Session struct {
+	mu     sync.Mutex
+	writes map[ShardID]time.Time // shard -> last write
+}
+
+// NewSession returns an empty session.
+func NewSession() *Session {
+	return &Session{writes: make(map[ShardID]time.Time)}
+}
+
+type sessionKey struct{}
+
+// WithSession returns a context carrying s.
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+func sessionFrom(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// wrote records a write to shard. It accepts a nil session.
+func (s *Session) wrote(shard ShardID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes[shard] = time.Now()
+}
+
+// pinned reports whether reads of shard must go to the primary.
+func (s *Session) pinned(shard ShardID, pinFor time.Duration) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.writes[shard]
+	return ok && (pinFor <= 0 || time.Since(at) < pinFor)
+}
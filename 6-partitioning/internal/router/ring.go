@@ -2,6 +2,7 @@ package router
 
 import (
 	"hash/fnv"
+	"math"
 	"sort"
 )
 
@@ -15,6 +16,7 @@ type ringPoint struct {
 type Ring struct {
 	points   []ringPoint
 	replicas int
+	weights  map[int]float64 // weight of every shard on the ring
 }
 
 // NewRing creates a ring with the given replica factor per shard.
@@ -25,25 +27,167 @@ func NewRing(replicas int) *Ring {
 	return &Ring{replicas: replicas}
 }
 
-// Build rebuilds the ring for the provided shard indices (e.g., []int{0,1,2}).
+// Build rebuilds the ring for the provided shard indices (e.g., []int{0,1,2}),
+// giving every shard the same number of virtual points.
 func (r *Ring) Build(shards []int) {
-	var pts []ringPoint
+	weights := make(map[int]float64, len(shards))
 	for _, s := range shards {
-		for v := 0; v < r.replicas; v++ {
-			// Compute a unique seed for this (shard, replica) pair and map it onto the 64‑bit space.
-			// 0x9e3779b97f4a7c15 is the 64‑bit golden ratio constant. Multiplying by it is a common trick
-			// to decorrelate sequential integers and spread them uniformly across 64‑bit range.
-			// We add +1 to the shard index so that shard 0 doesn't collapse to 0 before mixing.
-			// Adding the replica index (v) ensures virtual nodes land at distinct positions per shard.
-			seed := (uint64(s)+1)*0x9e3779b97f4a7c15 + uint64(v)
-			h := hashUint64(seed)
-			pts = append(pts, ringPoint{hash: h, owner: s})
-		}
+		weights[s] = 1
 	}
-	sort.Slice(pts, func(i, j int) bool { return pts[i].hash < pts[j].hash })
+	r.BuildWeighted(weights)
+}
+
+// BuildWeighted rebuilds the ring for the shards in weights (shard index -> weight).
+// A shard gets round(replicas * weight) virtual points, at least one, so its expected
+// share of the keyspace is proportional to its weight. Non-positive weights count as 1.
+// A shard keeps its first points when its weight changes, so only keys near the
+// added or removed points move.
+func (r *Ring) BuildWeighted(weights map[int]float64) {
+	r.weights = make(map[int]float64, len(weights))
+	var pts []ringPoint
+	for s, w := range weights {
+		w = normWeight(w)
+		r.weights[s] = w
+		pts = append(pts, shardPoints(s, shardSeed(s), r.vnodes(w))...)
+	}
+	sortPoints(pts)
 	r.points = pts
 }
 
+// Add inserts the points of shard with the given weight, replacing its points if it
+// is already on the ring. Points of other shards stay where they are, so only keys
+// in front of the new points move. Like Build, Add must not run concurrently with
+// Owner; use ShardRing to change a ring that is serving requests.
+func (r *Ring) Add(shard int, weight float64) {
+	if r.weights == nil {
+		r.weights = make(map[int]float64)
+	}
+	weight = normWeight(weight)
+	r.weights[shard] = weight
+	pts := shardPoints(shard, shardSeed(shard), r.vnodes(weight))
+	sortPoints(pts)
+	r.points = mergePoints(withoutOwner(r.points, shard), pts)
+}
+
+// Remove deletes the points of shard; its keys move to the next points clockwise.
+func (r *Ring) Remove(shard int) {
+	delete(r.weights, shard)
+	r.points = withoutOwner(r.points, shard)
+}
+
+// vnodes returns the number of virtual points of a shard with weight w.
+func (r *Ring) vnodes(w float64) int {
+	n := int(math.Round(float64(r.replicas) * w))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// normWeight replaces weights that cannot scale a point count by 1.
+func normWeight(w float64) float64 {
+	if w <= 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+		return 1
+	}
+	return w
+}
+
+// shardSeed is the seed of the points of shard index s.
+// 0x9e3779b97f4a7c15 is the 64‑bit golden ratio constant. Multiplying by it is a common trick
+// to decorrelate sequential integers and spread them uniformly across 64‑bit range.
+// We add +1 to the shard index so that shard 0 doesn't collapse to 0 before mixing.
+func shardSeed(s int) uint64 {
+	return (uint64(s) + 1) * 0x9e3779b97f4a7c15
+}
+
+// shardPoints places vnodes points for owner. Adding the replica index (v) to the
+// seed ensures virtual nodes land at distinct positions per shard. The points are
+// not sorted.
+func shardPoints(owner int, seed uint64, vnodes int) []ringPoint {
+	pts := make([]ringPoint, vnodes)
+	for v := range pts {
+		pts[v] = ringPoint{hash: hashUint64(seed + uint64(v)), owner: owner}
+	}
+	return pts
+}
+
+// pointBefore orders points by hash and breaks (unlikely) hash ties by owner, so the
+// ring does not depend on the order shards were added in.
+func pointBefore(a, b ringPoint) bool {
+	if a.hash != b.hash {
+		return a.hash < b.hash
+	}
+	return a.owner < b.owner
+}
+
+func sortPoints(pts []ringPoint) {
+	sort.Slice(pts, func(i, j int) bool { return pointBefore(pts[i], pts[j]) })
+}
+
+// mergePoints merges two sorted point lists into a new one.
+func mergePoints(a, b []ringPoint) []ringPoint {
+	out := make([]ringPoint, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if pointBefore(b[0], a[0]) {
+			out, b = append(out, b[0]), b[1:]
+		} else {
+			out, a = append(out, a[0]), a[1:]
+		}
+	}
+	return append(append(out, a...), b...)
+}
+
+// withoutOwner returns a new sorted list without the points of owner.
+func withoutOwner(pts []ringPoint, owner int) []ringPoint {
+	out := make([]ringPoint, 0, len(pts))
+	for _, p := range pts {
+		if p.owner != owner {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ShardShare compares the keyspace fraction a shard should own with the one it owns.
+type ShardShare struct {
+	Shard    int
+	Weight   float64
+	VNodes   int
+	Expected float64 // weight / total weight
+	Actual   float64 // fraction of the 64-bit keyspace owned by the shard's points
+}
+
+// Shares reports, per shard in index order, the expected and actual fraction of the
+// keyspace. Actual deviates from Expected because points land at random positions;
+// more virtual nodes shrink the gap.
+func (r *Ring) Shares() []ShardShare {
+	byShard := make(map[int]*ShardShare, len(r.weights))
+	var total float64
+	for s, w := range r.weights {
+		byShard[s] = &ShardShare{Shard: s, Weight: w}
+		total += w
+	}
+	for i, p := range r.points {
+		sh := byShard[p.owner]
+		sh.VNodes++
+		if len(r.points) == 1 {
+			sh.Actual = 1
+			continue
+		}
+		// A point owns the keys after the previous point, up to and including its own
+		// hash; uint64 subtraction wraps around for the first point.
+		prev := r.points[(i+len(r.points)-1)%len(r.points)].hash
+		sh.Actual += float64(p.hash-prev) / math.Exp2(64)
+	}
+	shares := make([]ShardShare, 0, len(byShard))
+	for _, sh := range byShard {
+		sh.Expected = sh.Weight / total
+		shares = append(shares, *sh)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Shard < shares[j].Shard })
+	return shares
+}
+
 // Owner returns shard index for a given 64-bit key hash.
 func (r *Ring) Owner(key uint64) int {
 	if len(r.points) == 0 {
@@ -56,6 +200,27 @@ func (r *Ring) Owner(key uint64) int {
 	return r.points[i].owner
 }
 
+// walk visits the distinct shards clockwise from key's owner, in ring order, until
+// fn returns false.
+func (r *Ring) walk(key uint64, fn func(shard int) bool) {
+	n := len(r.points)
+	if n == 0 {
+		return
+	}
+	start := sort.Search(n, func(i int) bool { return r.points[i].hash >= key })
+	seen := make(map[int]bool, len(r.weights))
+	for i := 0; i < n && len(seen) < len(r.weights); i++ {
+		s := r.points[(start+i)%n].owner
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		if !fn(s) {
+			return
+		}
+	}
+}
+
 // HashUser makes a 64-bit hash from userID.
 func HashUser(u int64) uint64 {
 	// Use FNV-1a on 8 bytes to get stable 64-bit hash
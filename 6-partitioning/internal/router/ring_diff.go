@@ -0,0 +1,140 @@
+package router
+
+import (
+	"math"
+	"sort"
+)
+
+// HashRange is the key hashes h with Start <= h < End. End == 0 stands for 2^64, so
+// a range never wraps around the ring; the last range of the keyspace ends at 0.
+type HashRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// Contains reports whether key falls into the range.
+func (r HashRange) Contains(key uint64) bool {
+	return key >= r.Start && (r.End == 0 || key < r.End)
+}
+
+// Fraction returns the share of the 64-bit keyspace covered by the range.
+func (r HashRange) Fraction() float64 {
+	if r.Start == 0 && r.End == 0 {
+		return 1
+	}
+	return float64(r.End-r.Start) / math.Exp2(64) // End-Start wraps to the length when End == 0
+}
+
+// RangeMove is a hash range whose owner changes between two rings.
+type RangeMove struct {
+	HashRange
+	From int `json:"from"` // owner on the old ring
+	To   int `json:"to"`   // owner on the new ring
+}
+
+// Diff returns the hash ranges whose owner differs between r (old) and next (new),
+// in key order. Adjacent ranges with the same source and destination are merged.
+// Users can then be moved by range (see HashUser) without enumerating them; the
+// fractions of all moves add up to the share of users expected to move.
+func (r *Ring) Diff(next *Ring) []RangeMove {
+	// Every point p ends a segment (..., p] owned by p's shard, so the next segment
+	// starts at p+1. Between consecutive starts from both rings, neither owner changes.
+	starts := []uint64{0}
+	for _, pts := range [][]ringPoint{r.points, next.points} {
+		for _, p := range pts {
+			starts = append(starts, p.hash+1) // MaxUint64+1 wraps to 0, already present
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	var moves []RangeMove
+	for i, start := range starts {
+		if i > 0 && start == starts[i-1] {
+			continue
+		}
+		var end uint64 // 0 = 2^64
+		for j := i + 1; j < len(starts); j++ {
+			if starts[j] != start {
+				end = starts[j]
+				break
+			}
+		}
+		from, to := r.Owner(start), next.Owner(start)
+		if from == to {
+			continue
+		}
+		if n := len(moves); n > 0 && moves[n-1].End == start && moves[n-1].From == from && moves[n-1].To == to {
+			moves[n-1].End = end
+			continue
+		}
+		moves = append(moves, RangeMove{HashRange: HashRange{Start: start, End: end}, From: from, To: to})
+	}
+	return moves
+}
+
+// Diff returns the hash ranges whose owner differs between s and next (see
+// Ring.Diff). From is a slot of s and To a slot of next (see ShardRing.ID); in one
+// ring lineage they are the same numbering. Ranges kept by the same shard ID are not
+// reported, even if the rings number it differently.
+func (s *ShardRing) Diff(next *ShardRing) []RangeMove {
+	var moves []RangeMove
+	for _, m := range s.ring.Diff(&next.ring) {
+		if s.ID(m.From) == next.ID(m.To) {
+			continue
+		}
+		if n := len(moves); n > 0 && moves[n-1].End == m.Start && moves[n-1].From == m.From && moves[n-1].To == m.To {
+			moves[n-1].End = m.End
+			continue
+		}
+		moves = append(moves, m)
+	}
+	return moves
+}
+
+// RangeOwner is a hash range and the shard owning it.
+type RangeOwner struct {
+	HashRange
+	Shard int `json:"shard"`
+}
+
+// Ranges returns the hash ranges of the ring with their owners, in key order,
+// covering the whole keyspace. Adjacent ranges of one shard are merged.
+func (r *Ring) Ranges() []RangeOwner {
+	if len(r.points) == 0 {
+		return nil
+	}
+	var out []RangeOwner
+	add := func(start, end uint64, shard int) {
+		if n := len(out); n > 0 && out[n-1].End == start && out[n-1].Shard == shard {
+			out[n-1].End = end
+			return
+		}
+		out = append(out, RangeOwner{HashRange: HashRange{Start: start, End: end}, Shard: shard})
+	}
+	// Keys up to the first point, and after the last one, belong to the first point.
+	first := r.points[0]
+	add(0, first.hash+1, first.owner)
+	for i := 1; i < len(r.points); i++ {
+		if start := r.points[i-1].hash + 1; start != 0 && r.points[i].hash+1 != start {
+			add(start, r.points[i].hash+1, r.points[i].owner)
+		}
+	}
+	if last := r.points[len(r.points)-1].hash + 1; last != 0 {
+		add(last, 0, first.owner)
+	}
+	return out
+}
+
+// Ranges returns the hash ranges of the ring by owner slot (see Ring.Ranges).
+func (s *ShardRing) Ranges() []RangeOwner {
+	return s.ring.Ranges()
+}
+
+// MovedFraction sums the keyspace fractions of moves.
+func MovedFraction(moves []RangeMove) float64 {
+	var f float64
+	for _, m := range moves {
+		f += m.Fraction()
+	}
+	return f
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"math"
+	"testing"
+)
+
+// testRing builds a ring of the given shard indexes and weights.
+func testRing(replicas int, weights map[int]float64) *Ring {
+	r := NewRing(replicas)
+	r.BuildWeighted(weights)
+	return r
+}
+
+func TestRingRangesCoverKeyspace(t *testing.T) {
+	tests := []struct {
+		name string
+		ring *Ring
+	}{
+		{"one point", testRing(1, map[int]float64{0: 1})},
+		{"three shards", testRing(100, map[int]float64{0: 1, 1: 1, 2: 1})},
+		{"weighted", testRing(50, map[int]float64{0: 1, 1: 2, 2: 0.5, 3: 1})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges := tt.ring.Ranges()
+			if len(ranges) == 0 {
+				t.Fatal("no ranges")
+			}
+			if ranges[0].Start != 0 {
+				t.Errorf("first range starts at %d, want 0", ranges[0].Start)
+			}
+			if last := ranges[len(ranges)-1]; last.End != 0 {
+				t.Errorf("last range ends at %d, want 0 (2^64)", last.End)
+			}
+			var total float64
+			for i, r := range ranges {
+				if i > 0 && r.Start != ranges[i-1].End {
+					t.Errorf("range %d starts at %d, previous ends at %d", i, r.Start, ranges[i-1].End)
+				}
+				if r.End != 0 && r.End <= r.Start {
+					t.Errorf("range %d [%d, %d) is empty", i, r.Start, r.End)
+				}
+				if got := tt.ring.Owner(r.Start); got != r.Shard {
+					t.Errorf("range %d starts on shard %d, owned by %d", i, got, r.Shard)
+				}
+				if got := tt.ring.Owner(r.End - 1); got != r.Shard {
+					t.Errorf("range %d ends on shard %d, owned by %d", i, got, r.Shard)
+				}
+				total += r.Fraction()
+			}
+			if math.Abs(total-1) > 1e-9 {
+				t.Errorf("ranges cover %v of the keyspace, want 1", total)
+			}
+		})
+	}
+}
+
+func TestRingDiff(t *testing.T) {
+	three := map[int]float64{0: 1, 1: 1, 2: 1}
+	tests := []struct {
+		name     string
+		old, new *Ring
+		moved    float64 // expected fraction, ±0.05
+	}{
+		{"same ring", testRing(100, three), testRing(100, three), 0},
+		{"add a fourth", testRing(100, three), testRing(100, map[int]float64{0: 1, 1: 1, 2: 1, 3: 1}), 0.25},
+		{"remove one", testRing(100, three), testRing(100, map[int]float64{0: 1, 2: 1}), 1.0 / 3},
+		{"double a weight", testRing(100, three), testRing(100, map[int]float64{0: 2, 1: 1, 2: 1}), 1.0 / 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moves := tt.old.Diff(tt.new)
+			for i, m := range moves {
+				if i > 0 && (moves[i-1].End == 0 || m.Start < moves[i-1].End) {
+					t.Errorf("move %d [%d, %d) overlaps the previous one ending at %d", i, m.Start, m.End, moves[i-1].End)
+				}
+				if m.End != 0 && m.End <= m.Start {
+					t.Errorf("move %d [%d, %d) is empty", i, m.Start, m.End)
+				}
+				if m.From == m.To {
+					t.Errorf("move %d stays on shard %d", i, m.From)
+				}
+				for _, key := range []uint64{m.Start, m.End - 1} {
+					if from, to := tt.old.Owner(key), tt.new.Owner(key); from != m.From || to != m.To {
+						t.Errorf("move %d says %d -> %d, key %d goes %d -> %d", i, m.From, m.To, key, from, to)
+					}
+				}
+			}
+			// Keys outside every move keep their owner.
+			for _, r := range tt.old.Ranges() {
+				if !coveredBy(moves, r.Start) && tt.new.Owner(r.Start) != r.Shard {
+					t.Errorf("key %d changes owner but is in no move", r.Start)
+				}
+			}
+			if got := MovedFraction(moves); math.Abs(got-tt.moved) > 0.05 {
+				t.Errorf("moved %.3f of the keyspace, want about %.3f", got, tt.moved)
+			}
+		})
+	}
+}
+
+func coveredBy(moves []RangeMove, key uint64) bool {
+	for _, m := range moves {
+		if m.Contains(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package router
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// splitPoints places a point for dst inside every arc owned by src: the arc (prev, p]
+// of a src point p is cut at prev + fraction × its length, so dst owns the first part
+// and src keeps the rest. Arcs too short to cut get no point. The points are sorted.
+func splitPoints(pts []ringPoint, src, dst int, fraction float64) []ringPoint {
+	var out []ringPoint
+	for i, p := range pts {
+		if p.owner != src {
+			continue
+		}
+		prev := pts[(i+len(pts)-1)%len(pts)].hash
+		arc := float64(p.hash - prev) // uint64 subtraction wraps around for the first point
+		if len(pts) == 1 {
+			arc = math.Exp2(64)
+		}
+		cut := fraction * arc
+		if cut < 1 || cut >= arc {
+			continue
+		}
+		out = append(out, ringPoint{hash: prev + uint64(cut), owner: dst})
+	}
+	sortPoints(out)
+	return out
+}
+
+// checkFraction rejects split fractions that would not leave keys on both shards.
+func checkFraction(f float64) error {
+	if !(f > 0 && f < 1) {
+		return fmt.Errorf("split fraction must be in (0, 1), got %v", f)
+	}
+	return nil
+}
+
+// Split adds shard dst with one point inside every arc of shard src, taking fraction of
+// each (see splitPoints). dst thus takes about fraction of src's keys and nothing from
+// any other shard, unlike Add, whose points land anywhere on the ring. The weights
+// become src: w × (1-fraction) and dst: w × fraction. A later Add of either shard
+// places its points from its index again.
+func (r *Ring) Split(src, dst int, fraction float64) error {
+	w, ok := r.weights[src]
+	if !ok {
+		return fmt.Errorf("shard %d is not on the ring", src)
+	}
+	if _, ok := r.weights[dst]; ok {
+		return fmt.Errorf("shard %d is already on the ring", dst)
+	}
+	if err := checkFraction(fraction); err != nil {
+		return err
+	}
+	pts := splitPoints(r.points, src, dst, fraction)
+	if len(pts) == 0 {
+		return fmt.Errorf("shard %d has no arc long enough to split", src)
+	}
+	r.weights[src], r.weights[dst] = w*(1-fraction), w*fraction
+	r.points = mergePoints(r.points, pts)
+	return nil
+}
+
+// Split returns a ring with a new shard id on pool that takes fraction of the keys of
+// shard src, and only of src (see Ring.Split): a hot shard hands part of every one of
+// its ranges to a new node, and Diff against the new ring lists moves from src only.
+// The points of both shards no longer follow from their IDs, so Spec records them.
+func (s *ShardRing) Split(src, id ShardID, pool *pgxpool.Pool, fraction float64) (*ShardRing, error) {
+	srcSlot, ok := s.Slot(src)
+	if !ok {
+		return nil, fmt.Errorf("shard %s is not on the ring", src)
+	}
+	if id == "" {
+		return nil, fmt.Errorf("empty shard id")
+	}
+	if _, ok := s.Slot(id); ok {
+		return nil, fmt.Errorf("shard %s is already on the ring", id)
+	}
+	if err := checkFraction(fraction); err != nil {
+		return nil, err
+	}
+	next := s.clone()
+	slot, ok := next.slots[id]
+	if !ok {
+		slot = len(next.ids)
+		next.slots[id] = slot
+		next.ids = append(next.ids, id)
+		next.pools = append(next.pools, nil)
+	}
+	next.pools[slot] = pool
+	if err := next.ring.Split(srcSlot, slot, fraction); err != nil {
+		return nil, fmt.Errorf("split %s: %w", src, err)
+	}
+	next.explicit[srcSlot], next.explicit[slot] = true, true
+	return next, nil
+}
@@ -0,0 +1,86 @@
+package router
+
+import (
+	"math"
+	"testing"
+)
+
+func TestShardRingSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		shards   []ShardID
+		replicas int
+		src      ShardID
+		fraction float64
+	}{
+		{"half of one of three", []ShardID{"shard_0", "shard_1", "shard_2"}, 100, "shard_1", 0.5},
+		{"a tenth", []ShardID{"shard_0", "shard_1", "shard_2"}, 100, "shard_0", 0.1},
+		{"most of it", []ShardID{"shard_0", "shard_1", "shard_2", "shard_3"}, 50, "shard_3", 0.9},
+		{"single shard", []ShardID{"shard_0"}, 1, "shard_0", 0.25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := NewShardRing(tt.replicas)
+			var err error
+			for _, id := range tt.shards {
+				if ring, err = ring.Add(id, nil, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			next, err := ring.Split(tt.src, "hot_1", nil, tt.fraction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src, _ := ring.Slot(tt.src)
+			dst, ok := next.Slot("hot_1")
+			if !ok {
+				t.Fatal("split shard is not on the new ring")
+			}
+			moves := ring.Diff(next)
+			if len(moves) == 0 {
+				t.Fatal("split moved nothing")
+			}
+			for _, m := range moves {
+				if m.From != src || m.To != dst {
+					t.Errorf("move [%d, %d) goes %s -> %s, want %s -> hot_1", m.Start, m.End, ring.ID(m.From), next.ID(m.To), tt.src)
+				}
+			}
+			var share float64
+			for _, sh := range ring.Shares() {
+				if sh.Shard == src {
+					share = sh.Actual
+				}
+			}
+			want := tt.fraction * share
+			if got := MovedFraction(moves); math.Abs(got-want) > 1e-9 {
+				t.Errorf("moved %.12f of the keyspace, want %.12f", got, want)
+			}
+		})
+	}
+}
+
+func TestShardRingSplitRejects(t *testing.T) {
+	ring, err := NewShardRing(10).Add("shard_0", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		src, id  ShardID
+		fraction float64
+	}{
+		{"zero fraction", "shard_0", "shard_1", 0},
+		{"whole shard", "shard_0", "shard_1", 1},
+		{"NaN", "shard_0", "shard_1", math.NaN()},
+		{"unknown source", "shard_9", "shard_1", 0.5},
+		{"existing target", "shard_0", "shard_0", 0.5},
+		{"empty target", "shard_0", "", 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ring.Split(tt.src, tt.id, nil, tt.fraction); err == nil {
+				t.Error("Split succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package router
+
+import (
+	"context"
+
+	"partitioning/ready/internal/model"
+)
+
+// FeedRouter is the read contract shared by every partitioning strategy.
+// Callers depend on it instead of a concrete router so a strategy can be picked by name.
+type FeedRouter interface {
+	// GetFeed returns the newest posts (created_at DESC) of the given users, at most limit rows.
+	// The time window is taken from ctx, see QueryFromContext.
+	GetFeed(ctx context.Context, userIDs []int64, limit int) ([]model.Post, error)
+	// QueryFeed returns the posts of the given users matching q, ordered by created_at DESC.
+	QueryFeed(ctx context.Context, userIDs []int64, q FeedQuery) ([]model.Post, error)
+	// QueryFeedPage returns one page of q and a token for the next page.
+	// Tokens are interchangeable between strategies.
+	QueryFeedPage(ctx context.Context, userIDs []int64, q FeedQuery) (FeedPage, error)
+}
+
+// Compile-time checks that all routers satisfy FeedRouter.
+var (
+	_ FeedRouter = (*BaselineRouter)(nil)
+	_ FeedRouter = (*RangeRouter)(nil)
+	_ FeedRouter = (*HashRouter)(nil)
+	_ FeedRouter = (*ConsistentHashRouter)(nil)
+	_ FeedRouter = (*DirectoryRouter)(nil)
+)
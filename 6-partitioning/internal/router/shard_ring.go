@@ -0,0 +1,252 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ShardID is a stable shard name, such as its host. Unlike a shard index it does not
+// change when other shards are added or removed.
+type ShardID string
+
+// ShardRing is an immutable, versioned consistent hashing ring over shards identified
+// by ShardID, each mapped to its pool. Add and Remove return a new ring with the next
+// version and only that shard's points inserted or deleted; the receiver is left as
+// is, so a router can keep serving from it until the new one is swapped in (see
+// LiveRing).
+//
+// Points are placed from the ID, so a shard lands at the same positions whatever else
+// is on the ring; only Split places the points of the two shards it involves next to
+// the points being split, and the topology file records those. Owner returns the
+// shard's slot: a number assigned on first Add and kept for the ID in every later
+// version, also after a Remove, so slots (unlike indexes into a pool slice) are never
+// renumbered. Pools is indexed by slot.
+type ShardRing struct {
+	version uint64
+	ring    Ring // owner = slot; never changed after the ShardRing is built
+	slots   map[ShardID]int
+	ids     []ShardID       // by slot
+	pools   []*pgxpool.Pool // by slot; nil when the shard is not on the ring
+	// A slot is on the ring iff ring.weights has it; pools may be nil for rings only
+	// used to compute placement.
+	explicit map[int]bool // slots whose points were placed by Split, not from their ID
+}
+
+var _ Partitioner = (*ShardRing)(nil)
+
+// NewShardRing creates an empty ring (version 0) with the given virtual nodes per
+// unit of weight.
+func NewShardRing(replicas int) *ShardRing {
+	return &ShardRing{ring: *NewRing(replicas), slots: map[ShardID]int{}, explicit: map[int]bool{}}
+}
+
+// Add returns a ring with shard id on pool, with round(replicas * weight) points
+// (at least one; non-positive weights count as 1). Adding an ID that is already on the
+// ring replaces its pool and weight. pool may be nil if the ring only computes
+// placement; routers reject such rings.
+func (s *ShardRing) Add(id ShardID, pool *pgxpool.Pool, weight float64) (*ShardRing, error) {
+	if id == "" {
+		return nil, fmt.Errorf("empty shard id")
+	}
+	next := s.clone()
+	slot, ok := next.slots[id]
+	if !ok {
+		slot = len(next.ids)
+		next.slots[id] = slot
+		next.ids = append(next.ids, id)
+		next.pools = append(next.pools, nil)
+	}
+	next.pools[slot] = pool
+	delete(next.explicit, slot)
+	weight = normWeight(weight)
+	next.ring.weights[slot] = weight
+	pts := shardPoints(slot, idSeed(id), next.ring.vnodes(weight))
+	sortPoints(pts)
+	next.ring.points = mergePoints(withoutOwner(s.ring.points, slot), pts)
+	return next, nil
+}
+
+// Remove returns a ring without shard id. Its keys move to the next points clockwise;
+// all other keys stay where they are.
+func (s *ShardRing) Remove(id ShardID) (*ShardRing, error) {
+	slot, ok := s.Slot(id)
+	if !ok {
+		return nil, fmt.Errorf("shard %s is not on the ring", id)
+	}
+	next := s.clone()
+	next.pools[slot] = nil
+	delete(next.explicit, slot)
+	delete(next.ring.weights, slot)
+	next.ring.points = withoutOwner(s.ring.points, slot)
+	return next, nil
+}
+
+// clone copies s with the next version. Points are not copied: callers replace them.
+func (s *ShardRing) clone() *ShardRing {
+	next := &ShardRing{
+		version:  s.version + 1,
+		ring:     Ring{points: s.ring.points, replicas: s.ring.replicas, weights: make(map[int]float64, len(s.ring.weights)+1)},
+		slots:    make(map[ShardID]int, len(s.slots)+1),
+		ids:      append([]ShardID(nil), s.ids...),
+		pools:    append([]*pgxpool.Pool(nil), s.pools...),
+		explicit: make(map[int]bool, len(s.explicit)+1),
+	}
+	for slot := range s.explicit {
+		next.explicit[slot] = true
+	}
+	for slot, w := range s.ring.weights {
+		next.ring.weights[slot] = w
+	}
+	for id, slot := range s.slots {
+		next.slots[id] = slot
+	}
+	return next
+}
+
+// Version counts the changes since NewShardRing.
+func (s *ShardRing) Version() uint64 {
+	return s.version
+}
+
+// Owner returns the slot of the shard owning key.
+func (s *ShardRing) Owner(key uint64) int {
+	return s.ring.Owner(key)
+}
+
+// OwnerID returns the shard owning key, or "" if the ring is empty.
+func (s *ShardRing) OwnerID(key uint64) ShardID {
+	if len(s.ring.points) == 0 {
+		return ""
+	}
+	return s.ids[s.ring.Owner(key)]
+}
+
+// Shards returns the IDs on the ring, sorted.
+func (s *ShardRing) Shards() []ShardID {
+	ids := make([]ShardID, 0, len(s.ids))
+	for slot, id := range s.ids {
+		if s.on(slot) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Slot returns the slot of id and whether id is on the ring.
+func (s *ShardRing) Slot(id ShardID) (int, bool) {
+	slot, ok := s.slots[id]
+	return slot, ok && s.on(slot)
+}
+
+// on reports whether slot is on the ring.
+func (s *ShardRing) on(slot int) bool {
+	_, ok := s.ring.weights[slot]
+	return ok
+}
+
+// ID returns the shard ID of slot.
+func (s *ShardRing) ID(slot int) ShardID {
+	if slot < 0 || slot >= len(s.ids) {
+		return ""
+	}
+	return s.ids[slot]
+}
+
+// Pool returns the pool of id, or nil if id is not on the ring.
+func (s *ShardRing) Pool(id ShardID) *pgxpool.Pool {
+	if slot, ok := s.Slot(id); ok {
+		return s.pools[slot]
+	}
+	return nil
+}
+
+// Weight returns the weight of id, or 0 if id is not on the ring.
+func (s *ShardRing) Weight(id ShardID) float64 {
+	if slot, ok := s.Slot(id); ok {
+		return s.ring.weights[slot]
+	}
+	return 0
+}
+
+// missingPool returns a shard on the ring without a pool, or "".
+func (s *ShardRing) missingPool() ShardID {
+	for slot, id := range s.ids {
+		if s.on(slot) && s.pools[slot] == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// Pools returns the pools by slot; removed shards have a nil entry.
+func (s *ShardRing) Pools() []*pgxpool.Pool {
+	return append([]*pgxpool.Pool(nil), s.pools...)
+}
+
+// Shares reports the expected and actual keyspace fraction by slot (see Ring.Shares).
+func (s *ShardRing) Shares() []ShardShare {
+	return s.ring.Shares()
+}
+
+// idSeed is the seed of the points of shard id.
+func idSeed(id ShardID) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id))
+	return h.Sum64()
+}
+
+// LiveRing holds the ShardRing a router currently serves from. Readers take one
+// snapshot per request, so a request never mixes two topologies; writers swap in a
+// new version atomically. The zero value holds no ring.
+type LiveRing struct {
+	cur atomic.Pointer[ShardRing]
+}
+
+// NewLiveRing returns a LiveRing serving r.
+func NewLiveRing(r *ShardRing) *LiveRing {
+	l := &LiveRing{}
+	l.cur.Store(r)
+	return l
+}
+
+// Load returns the current ring, or nil.
+func (l *LiveRing) Load() *ShardRing {
+	return l.cur.Load()
+}
+
+// Store swaps in r. It fails if r is not newer than the current ring, so a slow
+// writer cannot roll the topology back.
+func (l *LiveRing) Store(r *ShardRing) error {
+	for {
+		cur := l.cur.Load()
+		if cur != nil && r.Version() <= cur.Version() {
+			return fmt.Errorf("ring version %d is not newer than %d", r.Version(), cur.Version())
+		}
+		if l.cur.CompareAndSwap(cur, r) {
+			return nil
+		}
+	}
+}
+
+// Update applies change to the current ring and swaps in the result, retrying if
+// another writer swapped first.
+func (l *LiveRing) Update(change func(*ShardRing) (*ShardRing, error)) (*ShardRing, error) {
+	for {
+		cur := l.cur.Load()
+		if cur == nil {
+			return nil, fmt.Errorf("live ring is empty")
+		}
+		next, err := change(cur)
+		if err != nil {
+			return nil, err
+		}
+		if l.cur.CompareAndSwap(cur, next) {
+			return next, nil
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// RingHashVersion names the hash functions that place a ShardRing: keys are HashUser
+// (FNV-1a of the user ID) and points are hashUint64 (fmix64) of the FNV-1a of the
+// shard ID plus the point number. Topology files record it, and loading a file written
+// with other hash functions fails instead of silently routing users elsewhere.
+// Bump it whenever one of these functions changes.
+const RingHashVersion = "fnv1a-fmix64/v1"
+
+// RingSpec is the serializable form of a ShardRing. Two processes loading the same
+// spec route every user to the same shard.
+type RingSpec struct {
+	// Epoch is the ShardRing version; every Add, Remove or Split increments it.
+	Epoch uint64 `json:"epoch"`
+	// Hash is the RingHashVersion the ring was built with.
+	Hash string `json:"hash"`
+	// Replicas is the number of points per unit of weight.
+	Replicas int `json:"replicas"`
+	// Shards lists every shard ever added, by slot, including removed ones so their
+	// slots are not reused.
+	Shards []RingShardSpec `json:"shards"`
+}
+
+// RingShardSpec is one shard of a RingSpec.
+type RingShardSpec struct {
+	ID      ShardID `json:"id"`
+	Slot    int     `json:"slot"`
+	Weight  float64 `json:"weight,omitempty"`
+	Removed bool    `json:"removed,omitempty"`
+	// Points are the shard's ring positions when they do not follow from its ID and
+	// weight, i.e. after ShardRing.Split; otherwise they are left out.
+	Points []uint64 `json:"points,omitempty"`
+}
+
+// PoolResolver returns the pool of a shard ID, e.g. Topology.ShardPool.
+type PoolResolver func(ShardID) (*pgxpool.Pool, error)
+
+// Spec returns the serializable form of s.
+func (s *ShardRing) Spec() RingSpec {
+	spec := RingSpec{Epoch: s.version, Hash: RingHashVersion, Replicas: s.ring.replicas}
+	for slot, id := range s.ids {
+		sh := RingShardSpec{ID: id, Slot: slot, Removed: !s.on(slot)}
+		if !sh.Removed {
+			sh.Weight = s.ring.weights[slot]
+		}
+		if s.explicit[slot] {
+			for _, p := range s.ring.points {
+				if p.owner == slot {
+					sh.Points = append(sh.Points, p.hash)
+				}
+			}
+		}
+		spec.Shards = append(spec.Shards, sh)
+	}
+	return spec
+}
+
+// MarshalJSON encodes s as its RingSpec.
+func (s *ShardRing) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Spec())
+}
+
+// NewShardRingFromSpec rebuilds the ring described by spec. resolve supplies the
+// pools of the shards on the ring; with a nil resolve the ring only computes
+// placement (see ShardRing.Add).
+func NewShardRingFromSpec(spec RingSpec, resolve PoolResolver) (*ShardRing, error) {
+	if spec.Hash != RingHashVersion {
+		return nil, fmt.Errorf("ring hash %q, this build places keys with %q", spec.Hash, RingHashVersion)
+	}
+	if spec.Replicas <= 0 {
+		return nil, fmt.Errorf("ring replicas must be positive, got %d", spec.Replicas)
+	}
+	shards := append([]RingShardSpec(nil), spec.Shards...)
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Slot < shards[j].Slot })
+	r := NewShardRing(spec.Replicas)
+	r.version = spec.Epoch
+	r.ring.weights = make(map[int]float64, len(shards))
+	var pts []ringPoint
+	for i, sh := range shards {
+		if sh.Slot != i {
+			return nil, fmt.Errorf("shard %s: slot %d, expected %d (slots must be 0..n-1)", sh.ID, sh.Slot, i)
+		}
+		if sh.ID == "" {
+			return nil, fmt.Errorf("slot %d: empty shard id", i)
+		}
+		if _, dup := r.slots[sh.ID]; dup {
+			return nil, fmt.Errorf("shard %s listed twice", sh.ID)
+		}
+		r.slots[sh.ID] = i
+		r.ids = append(r.ids, sh.ID)
+		r.pools = append(r.pools, nil)
+		if sh.Removed {
+			continue
+		}
+		if err := checkWeight(i, sh.Weight); err != nil {
+			return nil, fmt.Errorf("shard %s: %w", sh.ID, err)
+		}
+		if resolve != nil {
+			pool, err := resolve(sh.ID)
+			if err != nil {
+				return nil, fmt.Errorf("shard %s: %w", sh.ID, err)
+			}
+			r.pools[i] = pool
+		}
+		r.ring.weights[i] = sh.Weight
+		if len(sh.Points) > 0 {
+			r.explicit[i] = true
+			for _, h := range sh.Points {
+				pts = append(pts, ringPoint{hash: h, owner: i})
+			}
+			continue
+		}
+		pts = append(pts, shardPoints(i, idSeed(sh.ID), r.ring.vnodes(sh.Weight))...)
+	}
+	sortPoints(pts)
+	r.ring.points = pts
+	return r, nil
+}
+
+// ReadTopologyFile loads a ring written by WriteTopologyFile.
+func ReadTopologyFile(path string, resolve PoolResolver) (*ShardRing, error) {
+	spec, err := readRingSpec(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewShardRingFromSpec(spec, resolve)
+	if err != nil {
+		return nil, fmt.Errorf("topology %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// WriteTopologyFile stores r at path, replacing the file atomically. Epochs only move
+// forward: it fails if the file holds a newer epoch, or a different ring with the same
+// epoch, so every reader of the file sees each epoch with a single placement.
+func WriteTopologyFile(path string, r *ShardRing) error {
+	data, err := json.MarshalIndent(r.Spec(), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if old, err := readRingSpec(path); err == nil {
+		oldData, _ := json.MarshalIndent(old, "", "  ")
+		switch {
+		case old.Epoch > r.Version():
+			return fmt.Errorf("topology %s has epoch %d, newer than %d", path, old.Epoch, r.Version())
+		case old.Epoch == r.Version() && !bytes.Equal(append(oldData, '\n'), data):
+			return fmt.Errorf("topology %s already has a different ring for epoch %d", path, old.Epoch)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the same
+// directory, so a crash leaves either the old file or the new one, never a part.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readRingSpec(path string) (RingSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RingSpec{}, err
+	}
+	var spec RingSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return RingSpec{}, fmt.Errorf("topology %s: %w", path, err)
+	}
+	return spec, nil
+}
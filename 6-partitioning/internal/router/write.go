@@ -0,0 +1,210 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"partitioning/ready/internal/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrNotFound is returned by DeletePost when no row matched.
+var ErrNotFound = errors.New("post not found")
+
+// ErrNoIDGenerator is returned by the sharded routers' InsertPosts when they have no
+// IDGenerator: a shared default would need a node ID that no other writer uses.
+var ErrNoIDGenerator = errors.New("no IDGenerator: set the router's IDs with a unique node ID (see NodeID)")
+
+// PostWriter is the write contract shared by every partitioning strategy.
+// Each implementation sends a write to the pool, table or partition that owns the row,
+// so readers of the same strategy find it.
+type PostWriter interface {
+	// InsertPost stores p and returns it with its assigned ID.
+	InsertPost(ctx context.Context, p model.Post) (model.Post, error)
+	// InsertPosts stores posts in batches and returns them, in input order, with IDs assigned.
+	// Sharded routers also return the posts when a write fails; a *PartialWriteError
+	// tells which of them are stored.
+	InsertPosts(ctx context.Context, posts []model.Post) ([]model.Post, error)
+	// DeletePost removes a post. userID is needed to find the owning shard.
+	DeletePost(ctx context.Context, userID, postID int64) error
+}
+
+// Compile-time checks that all routers satisfy PostWriter.
+var (
+	_ PostWriter = (*BaselineRouter)(nil)
+	_ PostWriter = (*RangeRouter)(nil)
+	_ PostWriter = (*HashRouter)(nil)
+	_ PostWriter = (*ConsistentHashRouter)(nil)
+	_ PostWriter = (*DirectoryRouter)(nil)
+)
+
+// NewWriter builds the strategy registered under mode and returns its write side.
+func NewWriter(mode string, t Topology) (PostWriter, error) {
+	r, err := New(mode, t)
+	if err != nil {
+		return nil, err
+	}
+	w, ok := r.(PostWriter)
+	if !ok {
+		return nil, fmt.Errorf("mode %q does not support writes", mode)
+	}
+	return w, nil
+}
+
+// insertPosts writes posts into table on pool in one batch and returns them with IDs filled in.
+// Posts with a non-zero ID keep it; the others get the table's default (sequence) value.
+// A zero CreatedAt is set to the current time. With hashed, the row also stores
+// UserHashKey(HashUser(user_id)) in user_hash (shard tables, see MoveRange).
+func insertPosts(ctx context.Context, pool *pgxpool.Pool, table string, posts []model.Post, hashed bool) ([]model.Post, error) {
+	if len(posts) == 0 {
+		return nil, nil
+	}
+	cols, vals := "user_id, created_at, content", "$1,$2,$3"
+	if hashed {
+		cols, vals = cols+", user_hash", vals+",$4"
+	}
+	withID := fmt.Sprintf(`INSERT INTO %s (%s, id) VALUES (%s,$%d) RETURNING id`, table, cols, vals, strings.Count(vals, "$")+1)
+	withoutID := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) RETURNING id`, table, cols, vals)
+	out := make([]model.Post, len(posts))
+	batch := &pgx.Batch{}
+	for i, p := range posts {
+		if p.CreatedAt.IsZero() {
+			p.CreatedAt = time.Now()
+		}
+		args := []any{p.UserID, p.CreatedAt, p.Content}
+		if hashed {
+			args = append(args, UserHashKey(HashUser(p.UserID)))
+		}
+		if p.ID != 0 {
+			batch.Queue(withID, append(args, p.ID)...)
+		} else {
+			batch.Queue(withoutID, args...)
+		}
+		out[i] = p
+	}
+	br := pool.SendBatch(ctx, batch)
+	for i := range out {
+		if err := br.QueryRow().Scan(&out[i].ID); err != nil {
+			_ = br.Close()
+			return nil, fmt.Errorf("insert into %s: %w", table, err)
+		}
+	}
+	if err := br.Close(); err != nil {
+		return nil, fmt.Errorf("close batch %s: %w", table, err)
+	}
+	return out, nil
+}
+
+// PartialWriteError is returned by InsertPosts of the sharded routers when a write
+// failed after some posts were stored. Posts holds every post in input order with the
+// ID and CreatedAt it was (or was to be) stored with, and Stored[i] reports whether
+// Posts[i] is on its owner. Retry Unstored() as is: with the same IDs, no post is
+// stored twice. During a rebalance Err may also come from the copy to the other owner
+// (all posts Stored); the Rebalancer's verify step fills that copy in.
+type PartialWriteError struct {
+	Posts  []model.Post
+	Stored []bool
+	Err    error
+}
+
+func (e *PartialWriteError) Error() string {
+	n := 0
+	for _, ok := range e.Stored {
+		if ok {
+			n++
+		}
+	}
+	return fmt.Sprintf("partial write, %d of %d posts stored: %v", n, len(e.Posts), e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// Unstored returns the posts that were not stored, with their IDs.
+func (e *PartialWriteError) Unstored() []model.Post {
+	var out []model.Post
+	for i, p := range e.Posts {
+		if !e.Stored[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// insertSharded assigns cross-shard unique IDs to posts without one, groups them by
+// owning shard and writes one batch per shard. IDs are assigned before any batch is
+// sent, so a failed write returns every post with its ID: a *PartialWriteError if
+// other shards stored theirs. Every shard written is recorded in the Session carried
+// by ctx, if any.
+func insertSharded(ctx context.Context, shards []*pgxpool.Pool, shardIDs []ShardID, table string, ids *IDGenerator, shardFor func(int64) int, posts []model.Post) ([]model.Post, error) {
+	if ids == nil {
+		return nil, ErrNoIDGenerator
+	}
+	out := make([]model.Post, len(posts))
+	perShard := make(map[int][]int) // shard -> indexes into out
+	for i, p := range posts {
+		if p.ID == 0 {
+			p.ID = ids.Next()
+		}
+		if p.CreatedAt.IsZero() {
+			p.CreatedAt = time.Now()
+		}
+		out[i] = p
+		s := shardFor(p.UserID)
+		perShard[s] = append(perShard[s], i)
+	}
+	stored := make([]bool, len(posts))
+	var errs []error
+	for s, idxs := range perShard {
+		batch := make([]model.Post, len(idxs))
+		for j, i := range idxs {
+			batch[j] = out[i]
+		}
+		// A batch is one implicit transaction: all of its posts are stored or none.
+		if _, err := insertPosts(ctx, shards[s], table, batch, true); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", s, err))
+			continue
+		}
+		sessionFrom(ctx).wrote(shardIDAt(shardIDs, s))
+		for _, i := range idxs {
+			stored[i] = true
+		}
+	}
+	if len(errs) == 0 {
+		return out, nil
+	}
+	err := errors.Join(errs...)
+	for _, ok := range stored {
+		if ok {
+			return out, &PartialWriteError{Posts: out, Stored: stored, Err: err}
+		}
+	}
+	return out, err
+}
+
+// deletePost removes one post of userID from table on pool.
+func deletePost(ctx context.Context, pool *pgxpool.Pool, table string, userID, postID int64) error {
+	tag, err := pool.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = $1 AND user_id = $2`, table), postID, userID)
+	if err != nil {
+		return fmt.Errorf("delete from %s: %w", table, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// firstPost unwraps the single-element result of a one-post insert. On an error the
+// post is returned too if the insert assigned its ID (see PartialWriteError).
+func firstPost(posts []model.Post, err error) (model.Post, error) {
+	if len(posts) == 0 {
+		return model.Post{}, err
+	}
+	return posts[0], err
+}
@@ -0,0 +1,9 @@
+-- Per-user shard overrides for DirectoryRouter (mode=directory).
+-- Lives on the baseline instance, which acts as the control plane for the shards.
+-- Users without a row are placed by the consistent hashing ring. shard is a shard ID
+-- (its host, see db.ShardHosts), not a position, so pins survive ring changes.
+CREATE TABLE IF NOT EXISTS shard_directory (
+  user_id BIGINT PRIMARY KEY,
+  shard TEXT NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
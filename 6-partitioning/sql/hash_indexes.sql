@@ -1,4 +1,5 @@
 -- Composite index for hashed/sharded tables to accelerate feed queries
 CREATE INDEX IF NOT EXISTS idx_posts_hash_user_created ON posts_hash (user_id, created_at DESC);
 
-
+-- Hash-range scans for migrations and repairs (router.MoveRange)
+CREATE INDEX IF NOT EXISTS idx_posts_hash_user_hash ON posts_hash (user_hash, id);
@@ -2,7 +2,8 @@ CREATE TABLE IF NOT EXISTS posts_hash (
   id BIGSERIAL PRIMARY KEY,
   user_id BIGINT NOT NULL,
   created_at TIMESTAMP NOT NULL,
-  content TEXT NOT NULL
+  content TEXT NOT NULL,
+  -- HashUser(user_id) with the sign bit flipped (router.UserHashKey), so ring ranges are index ranges
+  user_hash BIGINT NOT NULL
 );
 
-
@@ -0,0 +1,5 @@
+-- Adds user_hash to a posts_hash table created before the column existed.
+-- Fill it with `go run ./cmd/migrate -backfill`, then enforce it:
+--   ALTER TABLE posts_hash ALTER COLUMN user_hash SET NOT NULL;
+ALTER TABLE posts_hash ADD COLUMN IF NOT EXISTS user_hash BIGINT;
+CREATE INDEX IF NOT EXISTS idx_posts_hash_user_hash ON posts_hash (user_hash, id);
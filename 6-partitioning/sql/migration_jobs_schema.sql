@@ -0,0 +1,32 @@
+-- Resumable migration jobs (router.JobStore, cmd/migrate -job). router.EnsureJobTables
+-- runs this file (embedded by sql.MigrationJobs).
+-- Lives on the baseline instance, the control plane for the shards. A job moves a
+-- sharded table from one ring to another; every hash range that changes owner is
+-- one unit with its own state, so a restarted job skips the units already done.
+CREATE TABLE IF NOT EXISTS migration_jobs (
+  name TEXT PRIMARY KEY,
+  table_name TEXT NOT NULL,
+  status TEXT NOT NULL,             -- running | paused | done | failed
+  from_ring JSONB NOT NULL,
+  to_ring JSONB NOT NULL,
+  rows_per_second INT NOT NULL DEFAULT 0,
+  concurrency INT NOT NULL DEFAULT 1,
+  batch_size INT NOT NULL DEFAULT 1000,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS migration_units (
+  job TEXT NOT NULL REFERENCES migration_jobs (name) ON DELETE CASCADE,
+  seq INT NOT NULL,
+  hash_from BIGINT NOT NULL,        -- user_hash range [hash_from, hash_to)
+  hash_to BIGINT,                   -- NULL: up to the end of the keyspace
+  src TEXT NOT NULL,
+  dst TEXT NOT NULL,
+  state TEXT NOT NULL DEFAULT 'pending', -- pending | copying | verifying | done | failed
+  rows BIGINT NOT NULL DEFAULT 0,
+  attempts INT NOT NULL DEFAULT 0,
+  error TEXT,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (job, seq)
+);
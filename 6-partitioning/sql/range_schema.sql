@@ -6,6 +6,12 @@ CREATE TABLE IF NOT EXISTS posts_range (
   content TEXT
 ) PARTITION BY RANGE (created_at);
 
+-- IDs for rows written through the router (RangeRouter.InsertPost).
+-- After bulk-copying from posts, advance it past the copied IDs:
+--   SELECT setval('posts_range_id_seq', (SELECT max(id) FROM posts_range));
+CREATE SEQUENCE IF NOT EXISTS posts_range_id_seq;
+ALTER TABLE posts_range ALTER COLUMN id SET DEFAULT nextval('posts_range_id_seq');
+
 -- Partitions for 2024
 CREATE TABLE IF NOT EXISTS posts_range_2024_01 PARTITION OF posts_range
   FOR VALUES FROM ('2024-01-01') TO ('2024-02-01');
@@ -0,0 +1,10 @@
+-- Online rebalancing state for ConsistentHashRouter (router.RebalanceStore).
+-- Lives on the baseline instance, the control plane for the shards, next to
+-- shard_directory. One row per sharded table; rings are stored as RingSpec JSON.
+CREATE TABLE IF NOT EXISTS rebalance_state (
+  name TEXT PRIMARY KEY,
+  phase TEXT NOT NULL,
+  from_ring JSONB NOT NULL,
+  to_ring JSONB,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
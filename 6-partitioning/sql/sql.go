@@ -0,0 +1,10 @@
+// Package sql embeds the schema files the Go code applies itself, so each table is
+// defined once; the other files are run with psql (see README).
+package sql
+
+import _ "embed"
+
+// MigrationJobs is migration_jobs_schema.sql, applied by router.EnsureJobTables.
+//
+//go:embed migration_jobs_schema.sql
+var MigrationJobs string